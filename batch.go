@@ -0,0 +1,177 @@
+package keyless
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Maximum number of signatures in a batch.
+const maxBatchSize = 64
+
+var errBatchUnsupported = errors.New("batch signing not supported")
+
+type batcher struct {
+	sync.Mutex
+	active      int // requests in flight
+	pending     []*batchCall
+	timer       *time.Timer // flushes pending after a delay
+	unsupported bool
+}
+
+type batchCall struct {
+	Key    string `json:"key"`
+	Hash   string `json:"hash"`
+	Digest []byte `json:"digest"`
+
+	signature []byte
+	err       error
+	done      chan struct{}
+}
+
+// Signs a digest, coalescing concurrent calls into batches.
+func (c *Client) batchSign(id, hash string, digest []byte) ([]byte, error) {
+	b := &c.batch
+	b.Lock()
+
+	// not under load, sign immediately
+	if b.unsupported || b.active == 0 && len(b.pending) == 0 {
+		b.active++
+		b.Unlock()
+		defer func() {
+			b.Lock()
+			b.active--
+			b.Unlock()
+		}()
+		return c.sign(id, hash, digest)
+	}
+
+	call := &batchCall{Key: id, Hash: hash, Digest: digest, done: make(chan struct{})}
+	b.pending = append(b.pending, call)
+	switch len(b.pending) {
+	case 1:
+		b.timer = time.AfterFunc(c.BatchDelay, c.flushBatch)
+	case maxBatchSize:
+		// full: flush now, not when the next batch is half-way
+		b.timer.Stop()
+		go c.flushBatch()
+	}
+	b.Unlock()
+
+	<-call.done
+	return call.signature, call.err
+}
+
+// Sends all pending calls as a batch.
+func (c *Client) flushBatch() {
+	b := &c.batch
+	b.Lock()
+	calls := b.pending
+	b.pending = nil
+	if len(calls) == 0 {
+		b.Unlock()
+		return
+	}
+	b.active++
+	b.Unlock()
+
+	defer func() {
+		b.Lock()
+		b.active--
+		b.Unlock()
+	}()
+
+	if len(calls) > 1 {
+		if c.signBatch(calls) == nil {
+			return
+		}
+		// older servers don't support batches
+		b.Lock()
+		b.unsupported = true
+		b.Unlock()
+	}
+
+	// sign individually
+	var wg sync.WaitGroup
+	for _, call := range calls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(call.done)
+			call.signature, call.err = c.sign(call.Key, call.Hash, call.Digest)
+		}()
+	}
+	wg.Wait()
+}
+
+// Signs a batch of calls with a single request.
+// Only returns an error if the server does not support batches;
+// otherwise, errors are reported to each call.
+func (c *Client) signBatch(calls []*batchCall) error {
+	fail := func(err error) error {
+		for _, call := range calls {
+			call.err = fmt.Errorf("signing digest: %w", err)
+			close(call.done)
+		}
+		return nil
+	}
+
+	body, err := json.Marshal(calls)
+	if err != nil {
+		return fail(err)
+	}
+
+	req, err := c.newRequest("POST", "/sign/batch", bytes.NewReader(body))
+	if err != nil {
+		return fail(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := c.do(req)
+	if err != nil {
+		return fail(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		io.Copy(io.Discard, res.Body)
+		return errBatchUnsupported
+	}
+	if res.StatusCode != 200 {
+		return fail(responseError(res))
+	}
+
+	var results []struct {
+		Signature []byte `json:"signature"`
+		Status    int    `json:"status"`
+		Error     string `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&results); err != nil {
+		return fail(err)
+	}
+	if len(results) != len(calls) {
+		return fail(errors.New("unexpected number of signatures"))
+	}
+
+	for i, call := range calls {
+		res := results[i]
+		switch res.Status {
+		case http.StatusOK:
+			call.signature = res.Signature
+		case http.StatusNotFound:
+			// the key may have been rotated
+			c.invalidate(call.Key)
+			fallthrough
+		default:
+			call.err = fmt.Errorf("signing digest: %d %s", res.Status, res.Error)
+		}
+		close(call.done)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type agent struct {
+	api    *url.URL
+	token  string
+	client *http.Client
+
+	sync.Mutex
+	chain   []byte
+	etag    string
+	expires time.Time
+}
+
+func newAgent(api *url.URL, token string, client *http.Client) *agent {
+	return &agent{api: api, token: token, client: client}
+}
+
+// Serves the cached certificate chain, fetching it if needed,
+// or if the client asks for a fresh one (Cache-Control: no-cache).
+// Clients may cache it for as long as the agent does.
+func (a *agent) certificateHandler(w http.ResponseWriter, r *http.Request) {
+	fresh := strings.Contains(r.Header.Get("Cache-Control"), "no-cache")
+	chain, etag, expires, err := a.getChain(r.Context(), fresh)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	maxAge := max(time.Until(expires), 0)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(maxAge.Seconds())))
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(chain)
+}
+
+func (a *agent) getChain(ctx context.Context, fresh bool) (chain []byte, etag string, expires time.Time, err error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if !fresh && a.chain != nil && time.Now().Before(a.expires) {
+		return a.chain, a.etag, a.expires, nil
+	}
+
+	chain, etag, expires, err = a.fetchChain(ctx)
+	if err != nil {
+		return nil, "", expires, err
+	}
+	a.chain, a.etag, a.expires = chain, etag, expires
+	return chain, etag, expires, nil
+}
+
+// Periodically refreshes the cached certificate chain.
+func (a *agent) refresh(ctx context.Context) {
+	for {
+		chain, etag, expires, err := a.fetchChain(ctx)
+		if err != nil {
+			log.Println(err)
+		} else {
+			a.Lock()
+			a.chain, a.etag, a.expires = chain, etag, expires
+			a.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Hour):
+		}
+	}
+}
+
+func (a *agent) fetchChain(ctx context.Context) (chain []byte, etag string, expires time.Time, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", a.api.JoinPath("certificate").String(), nil)
+	if err != nil {
+		return nil, "", expires, fmt.Errorf("fetching certificate: %w", err)
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return nil, "", expires, fmt.Errorf("fetching certificate: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, "", expires, fmt.Errorf("fetching certificate: %s", res.Status)
+	}
+
+	chain, err = io.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", expires, fmt.Errorf("fetching certificate: %w", err)
+	}
+
+	// check the leaf certificate, and cache no longer than it is valid
+	block, _ := pem.Decode(chain)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, "", expires, errors.New("fetching certificate: no certificates returned")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, "", expires, fmt.Errorf("fetching certificate: %w", err)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return nil, "", expires, errors.New("fetching certificate: expired certificate")
+	}
+
+	// nor longer than the server allows
+	expires = time.Now().Add(2 * time.Hour)
+	if maxAge, ok := parseMaxAge(res.Header); ok && maxAge < 2*time.Hour {
+		expires = time.Now().Add(maxAge)
+	}
+	if leaf.NotAfter.Before(expires) {
+		expires = leaf.NotAfter
+	}
+	return chain, res.Header.Get("ETag"), expires, nil
+}
+
+// Returns the max-age of the Cache-Control header of a response,
+// or zero for no-cache and no-store.
+func parseMaxAge(header http.Header) (time.Duration, bool) {
+	var maxAge time.Duration
+	var found bool
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-cache" || directive == "no-store" {
+			return 0, true
+		}
+		if v, ok := strings.CutPrefix(directive, "max-age="); ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil {
+				return 0, true
+			}
+			maxAge, found = time.Duration(secs)*time.Second, true
+		}
+	}
+	return maxAge, found
+}
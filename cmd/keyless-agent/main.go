@@ -0,0 +1,184 @@
+// Command keyless-agent shares a keyless server connection between processes.
+//
+// It holds the API connection, client certificate and certificate chain,
+// and serves the keyless API on a Unix socket.
+// Processes use it by setting keyless.Client.Agent to the socket path.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+func main() {
+	apiURL := flag.String("api", "", "keyless server API `url` (required)")
+	certFile := flag.String("cert", "", "client certificate `file` for mTLS")
+	keyFile := flag.String("key", "", "client key `file` for mTLS")
+	tokenFile := flag.String("token", "", "bearer token `file`")
+	socket := flag.String("socket", "keyless-agent.sock", "Unix socket `path` to listen on")
+	group := flag.String("group", "", "`group` that may also use the socket (default: only the owner)")
+	flag.Parse()
+
+	if *apiURL == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	api, err := url.Parse(*apiURL)
+	if err != nil {
+		log.Fatalln("api:", err)
+	}
+	api.Path = strings.TrimRight(api.Path, "/")
+
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		IdleConnTimeout: 10 * time.Minute,
+	}
+	if *certFile != "" || *keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			log.Fatalln("mtls:", err)
+		}
+		transport.TLSClientConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+	}
+
+	var token string
+	if *tokenFile != "" {
+		buf, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			log.Fatalln("token:", err)
+		}
+		token = strings.TrimSpace(string(buf))
+	}
+
+	ln, err := listen(*socket, *group)
+	if err != nil {
+		log.Fatalln("listen:", err)
+	}
+
+	agent := newAgent(api, token, &http.Client{Transport: transport, Timeout: 5 * time.Second})
+
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := http.Server{
+		Handler:      agent.handler(transport),
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  10 * time.Minute,
+		BaseContext:  func(_ net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		err := server.Serve(ln)
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalln("agent server:", err)
+		}
+	}()
+
+	daemon.SdNotify(true, daemon.SdNotifyReady)
+	go agent.refresh(ctx)
+
+	<-shutdown
+	go func() {
+		log.Fatalln(<-shutdown)
+	}()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Fatalln("shutdown agent server:", err)
+	}
+}
+
+// Serves the cached certificate chain, and proxies everything else to the API.
+func (a *agent) handler(transport http.RoundTripper) http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(a.api)
+			if a.token != "" {
+				r.Out.Header.Set("Authorization", "Bearer "+a.token)
+			}
+		},
+		Transport: transport,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/certificate", a.certificateHandler)
+	mux.HandleFunc("/v2/certificate", a.certificateHandler)
+	mux.HandleFunc("/v2/events", func(w http.ResponseWriter, r *http.Request) {
+		// event streams are long lived, so no write timeout
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		proxy.ServeHTTP(w, r)
+	})
+	mux.Handle("/", proxy)
+	return mux
+}
+
+// Listens on the socket, which anyone who can connect to may sign with,
+// so only the owner, and optionally a group, are allowed to.
+// Socket-activated sockets are used as is (see SocketMode= and SocketGroup=).
+func listen(socket, group string) (net.Listener, error) {
+	lns, err := activation.Listeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(lns) > 1 {
+		return nil, errors.New("unexpected number of sockets")
+	}
+	if len(lns) == 1 {
+		return lns[0], nil
+	}
+
+	// remove a stale socket
+	if fi, err := os.Lstat(socket); err == nil && fi.Mode().Type() == os.ModeSocket {
+		os.Remove(socket)
+	}
+	ln, err := listenUnix(socket)
+	if err != nil {
+		return nil, err
+	}
+	if group != "" {
+		if err := chgrp(socket, group); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// Lets a group, by name or ID, use the socket.
+func chgrp(socket, group string) error {
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		if g, err = user.LookupGroupId(group); err != nil {
+			return err
+		}
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return err
+	}
+	if err := os.Chown(socket, -1, gid); err != nil {
+		return err
+	}
+	return os.Chmod(socket, 0o660)
+}
@@ -0,0 +1,119 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ncruces/keyless"
+	"github.com/ncruces/keyless/keylesstest"
+)
+
+func TestAgent(t *testing.T) {
+	srv := keylesstest.NewUnstartedServer()
+	srv.RequireClientCert = true
+	srv.CacheMaxAge = time.Hour
+	srv.Start()
+	defer srv.Close()
+
+	api, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			Certificates: []tls.Certificate{srv.ClientCertificate()},
+			RootCAs:      srv.RootCAs(),
+		},
+	}
+	agent := newAgent(api, "", &http.Client{Transport: transport})
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	ln, err := listen(socket, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Errorf("got mode %v, wanted %v", perm, os.FileMode(0o600))
+	}
+
+	server := http.Server{Handler: agent.handler(transport)}
+	go server.Serve(ln)
+	defer server.Close()
+
+	client := &keyless.Client{Agent: socket}
+	defer client.Close()
+
+	cert, err := client.Certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256([]byte("hello"))
+	signature, err := cert.PrivateKey.(crypto.Signer).Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(leaf.PublicKey.(*ecdsa.PublicKey), digest[:], signature) {
+		t.Error("invalid signature")
+	}
+
+	// the chain is cached as long as the server allows, and revalidated
+	unix := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}
+	get := func(etag string) *http.Response {
+		req, err := http.NewRequest("GET", "http://agent/v2/certificate", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		res, err := unix.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	res := get("")
+	var maxAge int
+	if _, err := fmt.Sscanf(res.Header.Get("Cache-Control"), "max-age=%d", &maxAge); err != nil ||
+		maxAge <= 0 || maxAge > 3600 {
+		t.Errorf("got Cache-Control %q", res.Header.Get("Cache-Control"))
+	}
+	etag := res.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+	if res := get(etag); res.StatusCode != http.StatusNotModified {
+		t.Errorf("got %d, wanted 304", res.StatusCode)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "net"
+
+// Listens on a Unix socket.
+func listenUnix(socket string) (net.Listener, error) {
+	return net.Listen("unix", socket)
+}
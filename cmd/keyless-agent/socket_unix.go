@@ -0,0 +1,17 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// Listens on a Unix socket that only the owner can connect to.
+func listenUnix(socket string) (net.Listener, error) {
+	// the socket is created with the umask,
+	// so there's no window where others can connect
+	mask := syscall.Umask(0o177)
+	defer syscall.Umask(mask)
+	return net.Listen("unix", socket)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var auditLog io.Writer
+
+// An entry in the audit log.
+type auditEntry struct {
+	Time        time.Time `json:"time"`
+	Address     string    `json:"address"`
+	RequestID   string    `json:"request_id,omitempty"`
+	Client      string    `json:"client,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Key         string    `json:"key"`
+	Hash        string    `json:"hash"`
+	Digest      string    `json:"digest,omitempty"`
+	Status      int       `json:"status"`
+	Result      string    `json:"result"`
+	Latency     float64   `json:"latency_ms"`
+}
+
+type auditEntryKey struct{}
+
+// Opens the audit log.
+func auditInit() error {
+	if config.Audit.File == "" {
+		return nil
+	}
+
+	f := &rotatingFile{
+		name:     config.Audit.File,
+		maxSize:  config.Audit.MaxSize << 20,
+		maxFiles: config.Audit.MaxFiles,
+	}
+	if f.maxFiles <= 0 {
+		f.maxFiles = 10
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	auditLog = f
+	return nil
+}
+
+// Writes an entry to the audit log for every request.
+func auditHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		entry := newAuditEntry(r, query.Get("key"), query.Get("hash"))
+
+		rec := statusRecorder{ResponseWriter: w}
+		ctx := context.WithValue(r.Context(), auditEntryKey{}, entry)
+		handler.ServeHTTP(&rec, r.WithContext(ctx))
+
+		entry.finish(rec.status())
+	})
+}
+
+func newAuditEntry(r *http.Request, key, hash string) *auditEntry {
+	return &auditEntry{
+		Time:      time.Now().UTC(),
+		Address:   r.RemoteAddr,
+		RequestID: requestID(r),
+		Key:       key,
+		Hash:      hash,
+	}
+}
+
+func (e *auditEntry) setClient(client apiClient) {
+	e.Client = client.ID
+	if client.Cert != nil {
+		hash := sha256.Sum256(client.Cert.Raw)
+		e.Fingerprint = hex.EncodeToString(hash[:])
+	}
+}
+
+func (e *auditEntry) setDigest(digest []byte) {
+	hash := sha256.Sum256(digest)
+	e.Digest = base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// Completes the entry with the status, and writes it.
+func (e *auditEntry) finish(status int) {
+	e.Latency = float64(time.Since(e.Time).Microseconds()) / 1000
+	e.Status = status
+	if e.Result == "" {
+		if e.Status == http.StatusOK {
+			e.Result = "ok"
+		} else {
+			e.Result = http.StatusText(e.Status)
+		}
+	}
+	logError(e.write())
+}
+
+// Records the client in the audit entry for a request.
+func auditClient(r *http.Request, client apiClient) {
+	if entry, ok := r.Context().Value(auditEntryKey{}).(*auditEntry); ok {
+		entry.setClient(client)
+	}
+}
+
+// Records a request denied by policy in its audit entry,
+// or in a new entry, for requests that aren't otherwise audited.
+func auditDenied(r *http.Request, client apiClient, result string) {
+	if entry, ok := r.Context().Value(auditEntryKey{}).(*auditEntry); ok {
+		entry.Result = result
+		return
+	}
+	entry := newAuditEntry(r, "", "")
+	entry.setClient(client)
+	entry.Result = result
+	entry.finish(http.StatusForbidden)
+}
+
+// Records the digest in the audit entry for a request.
+func auditDigest(r *http.Request, digest []byte) {
+	if entry, ok := r.Context().Value(auditEntryKey{}).(*auditEntry); ok {
+		entry.setDigest(digest)
+	}
+}
+
+// Records the detailed result in the audit entry for a request.
+func auditResult(r *http.Request, result string) {
+	if entry, ok := r.Context().Value(auditEntryKey{}).(*auditEntry); ok {
+		entry.Result = result
+	}
+}
+
+// Signs a digest for a client of a binary protocol,
+// recording it in the audit log, as HTTP requests are.
+func auditSign(ctx context.Context, addr string, client apiClient, keyID string, hash crypto.Hash, digest []byte) ([]byte, error) {
+	entry := newSignAuditEntry(addr, client, keyID, hash, digest)
+	signature, err := signDigest(ctx, keyID, hash.String(), digest)
+	if err != nil {
+		e := toAPIError(err)
+		entry.Result = e.Message
+		entry.finish(e.Status)
+		return nil, e
+	}
+	entry.finish(http.StatusOK)
+	return signature, nil
+}
+
+// Records a signing request of a binary protocol
+// that was refused before signing, like by policy or rate limit.
+func auditRefused(addr string, client apiClient, keyID string, hash crypto.Hash, digest []byte, err *apiError) {
+	entry := newSignAuditEntry(addr, client, keyID, hash, digest)
+	entry.Result = err.Message
+	entry.finish(err.Status)
+}
+
+func newSignAuditEntry(addr string, client apiClient, keyID string, hash crypto.Hash, digest []byte) *auditEntry {
+	entry := &auditEntry{
+		Time:    time.Now().UTC(),
+		Address: addr,
+		Key:     keyID,
+		Hash:    hash.String(),
+	}
+	entry.setClient(client)
+	entry.setDigest(digest)
+	return entry
+}
+
+func (e *auditEntry) write() error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if auditLog == nil {
+		log.Println("audit:", string(buf))
+		return nil
+	}
+	_, err = auditLog.Write(append(buf, '\n'))
+	return err
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusRecorder) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
+
+// An append-only file, rotated when it grows beyond maxSize.
+// Up to maxFiles rotated files are kept, as name.1, name.2, etc.
+type rotatingFile struct {
+	sync.Mutex
+	name     string
+	maxSize  int64
+	maxFiles int
+
+	file   *os.File
+	size   int64
+	reopen bool // rotated, but not yet reopened
+}
+
+// Opens the file, and only then closes the previous one,
+// so it can still be written to if opening fails.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if f.file != nil {
+		if err := f.file.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	f.file = file
+	f.size = fi.Size()
+	f.reopen = false
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if !f.reopen && f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		f.rotate()
+	}
+	if f.reopen {
+		// until this succeeds, keep writing to the rotated file
+		if err := f.open(); err != nil {
+			log.Println(err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() {
+	os.Remove(fmt.Sprintf("%s.%d", f.name, f.maxFiles))
+	for i := f.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.name, i), fmt.Sprintf("%s.%d", f.name, i+1))
+	}
+	if err := os.Rename(f.name, f.name+".1"); err != nil {
+		// keep appending to the same file
+		log.Println(err)
+	}
+	f.reopen = true
+}
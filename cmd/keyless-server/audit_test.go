@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.log")
+	f := &rotatingFile{name: name, maxSize: 10, maxFiles: 2}
+	if err := f.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { f.file.Close() }()
+
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for file, want := range map[string]string{
+		name:        "dddddddd\n",
+		name + ".1": "cccccccc\n",
+		name + ".2": "bbbbbbbb\n",
+	} {
+		got, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, wanted %q", filepath.Base(file), got, want)
+		}
+	}
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Errorf("kept too many files: %v", err)
+	}
+}
+
+func TestRotatingFile_reopen(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "audit.log")
+	f := &rotatingFile{name: name, maxSize: 10, maxFiles: 2}
+	if err := f.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { f.file.Close() }()
+
+	if _, err := f.Write([]byte("aaaaaaaa\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// fail to reopen, and keep writing to the open file
+	f.name = filepath.Join(dir, "missing", "audit.log")
+	if _, err := f.Write([]byte("bbbbbbbb\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !f.reopen {
+		t.Error("reopened a missing file")
+	}
+
+	// reopen on the next write
+	f.name = name
+	if _, err := f.Write([]byte("cccccccc\n")); err != nil {
+		t.Fatal(err)
+	}
+	if f.reopen {
+		t.Error("didn't reopen")
+	}
+
+	got, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "aaaaaaaa\nbbbbbbbb\ncccccccc\n"; string(got) != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var tokenKeys struct {
+	secret []byte            // HS256
+	public ed25519.PublicKey // EdDSA
+}
+
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+}
+
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	Expires   int64  `json:"exp"`
+}
+
+// Loads the keys used to verify bearer tokens.
+func loadTokenKeys() error {
+	if config.API.TokenSecret != "" {
+		secret, err := loadTokenSecret(config.API.TokenSecret)
+		if err != nil {
+			return err
+		}
+		tokenKeys.secret = secret
+	}
+
+	if config.API.TokenPublicKey != "" {
+		buf, err := os.ReadFile(config.API.TokenPublicKey)
+		if err != nil {
+			return err
+		}
+
+		blk, _ := pem.Decode(buf)
+		if blk == nil {
+			return errors.New("no PEM data found")
+		}
+		pub, err := x509.ParsePKIXPublicKey(blk.Bytes)
+		if err != nil {
+			return err
+		}
+		key, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("unexpected type %T", pub)
+		}
+		tokenKeys.public = key
+	}
+	return nil
+}
+
+func loadTokenSecret(file string) ([]byte, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	buf = bytes.TrimSpace(buf)
+	if len(buf) < 32 {
+		return nil, errors.New("token secret is too short")
+	}
+	return buf, nil
+}
+
+// Prints a bearer token for a client.
+// The token is signed with the configured HMAC secret,
+// or with an Ed25519 private key file.
+func printToken(args []string) {
+	log.SetFlags(0)
+	if len(args) < 2 || len(args) > 3 {
+		log.Fatalln("usage:", os.Args[0], "token <client_id> <validity> [ed25519_key]")
+	}
+
+	validity, err := time.ParseDuration(args[1])
+	if err != nil {
+		log.Fatalln("validity:", err)
+	}
+
+	var key any
+	if len(args) == 3 {
+		buf, err := os.ReadFile(args[2])
+		if err != nil {
+			log.Fatalln("key:", err)
+		}
+		blk, _ := pem.Decode(buf)
+		if blk == nil {
+			log.Fatalln("key: no PEM data found")
+		}
+		key, err = x509.ParsePKCS8PrivateKey(blk.Bytes)
+		if err != nil {
+			log.Fatalln("key:", err)
+		}
+	} else {
+		if err := loadConfig(); err != nil {
+			log.Fatalln("configuration:", err)
+		}
+		if config.API.TokenSecret == "" {
+			log.Fatalln("configuration: api.token_secret file path is not configured")
+		}
+		key, err = loadTokenSecret(config.API.TokenSecret)
+		if err != nil {
+			log.Fatalln("configuration:", err)
+		}
+	}
+
+	token, err := createToken(key, args[0], validity)
+	if err != nil {
+		log.Fatalln("token:", err)
+	}
+	fmt.Println(token)
+}
+
+func tokensEnabled() bool {
+	return config.API.TokenSecret != "" || config.API.TokenPublicKey != ""
+}
+
+// Reports if clients must authenticate,
+// with a client certificate or a bearer token.
+// Requests on the plain HTTP listener have no certificate,
+// so they must also be checked.
+func authRequired() bool {
+	return config.API.ClientCA != "" || enrollCA != nil || tokensEnabled()
+}
+
+// Creates a token for a client, signed with key.
+// The key is either an HMAC secret, or an Ed25519 private key.
+func createToken(key any, client string, validity time.Duration) (string, error) {
+	var header tokenHeader
+	switch key.(type) {
+	case []byte:
+		header.Algorithm = "HS256"
+	case ed25519.PrivateKey:
+		header.Algorithm = "EdDSA"
+	default:
+		return "", fmt.Errorf("unexpected type %T", key)
+	}
+	header.Type = "JWT"
+
+	now := time.Now()
+	claims := tokenClaims{
+		Subject:  client,
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(validity).Unix(),
+	}
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	token := enc.EncodeToString(h) + "." + enc.EncodeToString(c)
+
+	var sig []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(token))
+		sig = mac.Sum(nil)
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, []byte(token))
+	}
+	return token + "." + enc.EncodeToString(sig), nil
+}
+
+// Verifies a token, and returns the client ID (subject).
+func verifyToken(token string) (string, error) {
+	enc := base64.RawURLEncoding
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	signed := token[:len(parts[0])+1+len(parts[1])]
+
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("malformed token")
+	}
+
+	var header tokenHeader
+	if buf, err := enc.DecodeString(parts[0]); err != nil {
+		return "", errors.New("malformed token")
+	} else if err := json.Unmarshal(buf, &header); err != nil {
+		return "", errors.New("malformed token")
+	}
+
+	// verify the signature before looking at the claims
+	switch {
+	case header.Algorithm == "HS256" && tokenKeys.secret != nil:
+		mac := hmac.New(sha256.New, tokenKeys.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return "", errors.New("invalid token signature")
+		}
+	case header.Algorithm == "EdDSA" && tokenKeys.public != nil:
+		if !ed25519.Verify(tokenKeys.public, []byte(signed), sig) {
+			return "", errors.New("invalid token signature")
+		}
+	default:
+		return "", errors.New("unsupported token algorithm")
+	}
+
+	var claims tokenClaims
+	if buf, err := enc.DecodeString(parts[1]); err != nil {
+		return "", errors.New("malformed token")
+	} else if err := json.Unmarshal(buf, &claims); err != nil {
+		return "", errors.New("malformed token")
+	}
+
+	now := time.Now().Unix()
+	if claims.Expires == 0 || now >= claims.Expires {
+		return "", errors.New("expired token")
+	}
+	if now < claims.NotBefore {
+		return "", errors.New("token not yet valid")
+	}
+	if claims.Subject == "" {
+		return "", errors.New("token has no subject")
+	}
+	return claims.Subject, nil
+}
+
+// Identifies the client making a request.
+type apiClient struct {
+	ID     string            // token subject, or certificate subject
+	Cert   *x509.Certificate // verified client certificate, if any
+	Policy *policy           // matching policy, if any
+}
+
+type apiClientKey struct{}
+
+func getClient(r *http.Request) apiClient {
+	client, _ := r.Context().Value(apiClientKey{}).(apiClient)
+	return client
+}
+
+// Requires clients to authenticate with either a
+// verified client certificate, or a bearer token,
+// and to be allowed to use endpoint by policy.
+func authHandler(endpoint string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var client apiClient
+
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			// connections may outlive a revocation
+			if err := checkRevoked(r.TLS.VerifiedChains); err != nil {
+				auditDenied(r, client, err.Error())
+				sendError(w, r, newAPIError(http.StatusUnauthorized, codeUnauthorized, "revoked certificate"))
+				return
+			}
+			client.Cert = r.TLS.VerifiedChains[0][0]
+			client.ID = client.Cert.Subject.String()
+		} else if tokensEnabled() {
+			auth := r.Header.Get("Authorization")
+			token, ok := strings.CutPrefix(auth, "Bearer ")
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer`)
+				sendError(w, r, newAPIError(http.StatusUnauthorized, codeUnauthorized, ""))
+				return
+			}
+			id, err := verifyToken(strings.TrimSpace(token))
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				sendError(w, r, newAPIError(http.StatusUnauthorized, codeUnauthorized, ""))
+				return
+			}
+			client.ID = id
+		} else if authRequired() {
+			sendError(w, r, newAPIError(http.StatusUnauthorized, codeUnauthorized, "client certificate required"))
+			return
+		}
+
+		policy, ok := findPolicy(client)
+		client.Policy = policy
+		auditClient(r, client)
+		if !ok || !policy.allowsEndpoint(endpoint) {
+			auditDenied(r, client, endpoint+" not allowed by policy")
+			sendError(w, r, newAPIError(http.StatusForbidden, codeForbidden, ""))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), apiClientKey{}, client)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
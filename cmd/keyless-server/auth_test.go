@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenKeys.secret = secret
+	tokenKeys.public = public
+	defer func() {
+		tokenKeys.secret = nil
+		tokenKeys.public = nil
+	}()
+
+	tests := []struct {
+		name     string
+		key      any
+		validity time.Duration
+		tamper   func(string) string
+		wantErr  bool
+	}{
+		{"hmac", secret, time.Hour, nil, false},
+		{"ed25519", private, time.Hour, nil, false},
+		{"expired", secret, -time.Hour, nil, true},
+		{"wrong secret", []byte("another secret"), time.Hour, nil, true},
+		{"tampered", secret, time.Hour, func(s string) string {
+			return strings.Replace(s, ".", ".e30", 1)
+		}, true},
+		{"unsigned", secret, time.Hour, func(s string) string {
+			return s[:strings.LastIndexByte(s, '.')+1]
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := createToken(tt.key, "client", tt.validity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.tamper != nil {
+				token = tt.tamper(token)
+			}
+			id, err := verifyToken(token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, wanted error %v", err, tt.wantErr)
+			}
+			if err == nil && id != "client" {
+				t.Errorf("got %q, wanted %q", id, "client")
+			}
+		})
+	}
+}
+
+func TestAuthHandler_required(t *testing.T) {
+	defer func() {
+		config.API.ClientCA = ""
+		config.API.TokenSecret = ""
+		enrollCA = nil
+	}()
+
+	tests := []struct {
+		name      string
+		configure func()
+		want      int
+	}{
+		{"none", func() {}, http.StatusOK},
+		{"client_ca", func() { config.API.ClientCA = "ca.pem" }, http.StatusUnauthorized},
+		{"enroll", func() { enrollCA = &tls.Certificate{} }, http.StatusUnauthorized},
+		{"token_secret", func() { config.API.TokenSecret = "secret" }, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.API.ClientCA = ""
+			config.API.TokenSecret = ""
+			enrollCA = nil
+			tt.configure()
+
+			// as on the plain HTTP listener: no TLS
+			for _, endpoint := range []string{"sign", "keys", "stats"} {
+				handler := authHandler(endpoint, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("GET", "/"+endpoint, nil))
+				if w.Code != tt.want {
+					t.Errorf("%s: got %d, wanted %d", endpoint, w.Code, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Maximum number of items in a batch.
+const maxBatchSize = 64
+
+type batchItem struct {
+	Key    string `json:"key"`
+	Hash   string `json:"hash"`
+	Digest []byte `json:"digest"`
+}
+
+type batchResult struct {
+	Signature []byte `json:"signature,omitempty"`
+	Status    int    `json:"status"`
+	Code      string `json:"code,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Signs a batch of digests, returning signatures in order.
+// Each item succeeds or fails individually.
+func batchSigningHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		sendError(w, r, newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, ""))
+		return
+	}
+	if !checkContentType(w, r, "application/json") {
+		return
+	}
+
+	var items []batchItem
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchSize*512)
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		sendError(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, ""))
+		return
+	}
+	if len(items) == 0 || len(items) > maxBatchSize {
+		sendError(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest,
+			fmt.Sprintf("batch must have 1 to %d items", maxBatchSize)))
+		return
+	}
+
+	if !checkRateLimit(w, r, len(items)) {
+		return
+	}
+
+	client := getClient(r)
+	results := make([]batchResult, len(items))
+	for i, item := range items {
+		start := time.Now()
+		entry := newAuditEntry(r, item.Key, item.Hash)
+		entry.setClient(client)
+		entry.setDigest(item.Digest)
+
+		res := &results[i]
+		if !client.Policy.allowsKey(item.Key) {
+			res.Status = http.StatusForbidden
+			res.Code = codeForbidden
+			res.Error = "key not allowed"
+			entry.Result = "key not allowed by policy"
+		} else if sig, err := signDigest(r.Context(), item.Key, item.Hash, item.Digest); err != nil {
+			e := toAPIError(err)
+			res.Status = e.Status
+			res.Code = e.Code
+			res.Error = e.Message
+			entry.Result = e.Message
+		} else {
+			res.Status = http.StatusOK
+			res.Signature = sig
+		}
+
+		entry.finish(res.Status)
+		observeSignItem(item.Key, item.Hash, res.Status, time.Since(start))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
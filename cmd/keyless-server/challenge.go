@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Serves HTTP-01 challenges, and redirects everything else
+// to HTTPS on the API hostname.
+// It's meant to listen on port 80.
+func challengeInit() *http.Server {
+	var mux http.ServeMux
+	mux.HandleFunc("/.well-known/acme-challenge/", solvers.HandleHTTPChallenge)
+	mux.HandleFunc("/", redirectHandler)
+
+	return &http.Server{
+		Handler:      &mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		IdleTimeout:  time.Minute,
+	}
+}
+
+func redirectHandler(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	// keep API hostnames, or redirect to the main one
+	hostnames := apiHostnames()
+	if len(hostnames) > 0 && !slices.Contains(hostnames, strings.ToLower(host)) {
+		host = hostnames[0]
+	}
+
+	status := http.StatusPermanentRedirect
+	if r.Method == "GET" || r.Method == "HEAD" {
+		status = http.StatusMovedPermanently
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectHandler(t *testing.T) {
+	defer func(handler string, handlers []string) {
+		config.API.Handler, config.API.Handlers = handler, handlers
+	}(config.API.Handler, config.API.Handlers)
+	config.API.Handlers = []string{"old.example.com/api/", "keyless.example.com/"}
+
+	tests := []struct {
+		handler string
+		method  string
+		url     string
+		status  int
+		target  string
+	}{
+		{"keyless.example.com/", "GET", "http://keyless.example.com/certificate?x", http.StatusMovedPermanently, "https://keyless.example.com/certificate?x"},
+		{"keyless.example.com/api/", "POST", "http://other.example.com/api/sign", http.StatusPermanentRedirect, "https://keyless.example.com/api/sign"},
+		{"keyless.example.com/", "GET", "http://old.example.com:80/api/keys", http.StatusMovedPermanently, "https://old.example.com/api/keys"},
+		{"/", "GET", "http://new.example.com:80/keys", http.StatusMovedPermanently, "https://old.example.com/keys"},
+	}
+	for _, tt := range tests {
+		config.API.Handler = tt.handler
+		w := httptest.NewRecorder()
+		challengeInit().Handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.url, nil))
+		if w.Code != tt.status || w.Header().Get("Location") != tt.target {
+			t.Errorf("%s %s: got %d %q, wanted %d %q", tt.method, tt.url, w.Code, w.Header().Get("Location"), tt.status, tt.target)
+		}
+	}
+
+	// challenges are not redirected
+	w := httptest.NewRecorder()
+	challengeInit().Handler.ServeHTTP(w, httptest.NewRequest("GET", "http://keyless.example.com/.well-known/acme-challenge/token", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d for an unknown challenge, wanted 404", w.Code)
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"slices"
+	"strings"
+	"time"
 )
 
 var config struct {
@@ -16,11 +19,41 @@ var config struct {
 	MasterKey   string `json:"master_key"`  // required, file path
 	LegacyKeys  string `json:"legacy_keys"` // optional, file glob
 
+	LegacyKeysRetire string `json:"legacy_keys_retire"` // optional, RFC 3339 time
+
 	API struct {
 		Handler     string `json:"handler"`     // required
 		Certificate string `json:"certificate"` // required, file path
 		Key         string `json:"key"`         // required, file path
 		ClientCA    string `json:"client_ca"`   // optional, file path
+
+		ClientDenylist string `json:"client_denylist"` // optional, file path, reloaded on change
+		ClientCRL      string `json:"client_crl"`      // optional, file path, reloaded on change
+
+		Handlers []string `json:"handlers"` // optional, more handlers, e.g. for other hostnames
+
+		Enroll struct {
+			Certificate string `json:"certificate"` // optional, file path, intermediate CA
+			Key         string `json:"key"`         // optional, file path
+			Validity    int    `json:"validity"`    // optional, hours
+		} `json:"enroll"`
+
+		TokenSecret    string `json:"token_secret"`     // optional, file path
+		TokenPublicKey string `json:"token_public_key"` // optional, file path
+
+		Hashes []string `json:"hashes"` // optional, reloadable
+
+		Policies []policy `json:"policies"` // optional, reloadable
+
+		Queue struct {
+			Size    int `json:"size"`    // optional
+			Timeout int `json:"timeout"` // optional, milliseconds
+		} `json:"queue"`
+
+		RateLimit struct {
+			IP     rateLimit `json:"ip"`     // optional
+			Client rateLimit `json:"client"` // optional
+		} `json:"rate_limit"` // reloadable
 	} `json:"api"`
 
 	LetsEncrypt struct {
@@ -29,6 +62,25 @@ var config struct {
 	} `json:"letsencrypt"`
 
 	Replica string `json:"replica"` // optional
+	Metrics string `json:"metrics"` // optional, listen address
+
+	// used when not socket-activated
+	Listen struct {
+		API     string `json:"api"`     // optional, TLS listen address
+		HTTP    string `json:"http"`    // optional, plain HTTP listen address
+		DNS     string `json:"dns"`     // optional, UDP and TCP listen address
+		Replica string `json:"replica"` // optional, UDP listen address
+
+		Challenge string `json:"challenge"` // optional, port 80 listen address
+		Keyless   string `json:"keyless"`   // optional, Keyless SSL (gokeyless) listen address
+		DoH       string `json:"doh"`       // optional, DNS over HTTPS listen address
+	} `json:"listen"`
+
+	Audit struct {
+		File     string `json:"file"`      // optional, file path
+		MaxSize  int64  `json:"max_size"`  // optional, megabytes
+		MaxFiles int    `json:"max_files"` // optional
+	} `json:"audit"`
 }
 
 func loadConfig() error {
@@ -55,9 +107,31 @@ func loadConfig() error {
 	if config.MasterKey == "" {
 		return errors.New("master_key file path is not configured")
 	}
+	if config.LegacyKeysRetire != "" {
+		if _, err := time.Parse(time.RFC3339, config.LegacyKeysRetire); err != nil {
+			return fmt.Errorf("legacy_keys_retire: %w", err)
+		}
+	}
 	if config.API.Handler == "" {
 		return errors.New("api.handler is not configured")
 	}
+	if config.API.ClientCA == "" && config.API.Enroll.Certificate == "" &&
+		(config.API.ClientDenylist != "" || config.API.ClientCRL != "") {
+		return errors.New("api.client_denylist and api.client_crl require api.client_ca or api.enroll")
+	}
+	if (config.API.Enroll.Certificate == "") != (config.API.Enroll.Key == "") {
+		return errors.New("api.enroll requires both certificate and key file paths")
+	}
+	if config.API.Enroll.Certificate != "" && config.API.ClientCA == "" &&
+		config.API.TokenSecret == "" && config.API.TokenPublicKey == "" {
+		// someone must be able to enroll first
+		return errors.New("api.enroll requires api.client_ca or bearer tokens")
+	}
+	for _, h := range config.API.Handlers {
+		if !strings.Contains(h, "/") {
+			return fmt.Errorf("api.handlers: invalid handler: %q", h)
+		}
+	}
 	if config.API.Certificate == "" {
 		return errors.New("api.certificate file path is not configured")
 	}
@@ -71,5 +145,77 @@ func loadConfig() error {
 		return errors.New("letsencrypt.account_key file path is not configured")
 	}
 
+	if err := setHashes(config.API.Hashes); err != nil {
+		return err
+	}
+	setRateLimits(config.API.RateLimit.IP, config.API.RateLimit.Client)
+	if err := setPolicies(config.API.Policies); err != nil {
+		return err
+	}
 	return dnsConfig()
 }
+
+// Returns the API handlers: api.handler, then api.handlers.
+func apiHandlers() []string {
+	handlers := []string{config.API.Handler}
+	for _, h := range config.API.Handlers {
+		if !slices.Contains(handlers, h) {
+			handlers = append(handlers, h)
+		}
+	}
+	return handlers
+}
+
+// Returns the hostnames of the API handlers,
+// which the API certificate must cover.
+// The hostname of api.handler comes first.
+func apiHostnames() []string {
+	var hostnames []string
+	for _, h := range apiHandlers() {
+		if i := strings.IndexByte(h, '/'); i > 0 {
+			if host := strings.ToLower(h[:i]); !slices.Contains(hostnames, host) {
+				hostnames = append(hostnames, host)
+			}
+		}
+	}
+	return hostnames
+}
+
+// Reloads the parts of config.json that can change without a restart.
+func reloadConfig() error {
+	f, err := os.Open("config.json")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// decode into a new struct, as handlers read the current config
+	var cfg struct {
+		API struct {
+			Hashes    []string `json:"hashes"`
+			Policies  []policy `json:"policies"`
+			RateLimit struct {
+				IP     rateLimit `json:"ip"`
+				Client rateLimit `json:"client"`
+			} `json:"rate_limit"`
+		} `json:"api"`
+	}
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		return fmt.Errorf("config.json: %w", err)
+	}
+
+	if err := setHashes(cfg.API.Hashes); err != nil {
+		return err
+	}
+	if err := setPolicies(cfg.API.Policies); err != nil {
+		return err
+	}
+	setRateLimits(cfg.API.RateLimit.IP, cfg.API.RateLimit.Client)
+	if err := loadRevocations(); err != nil {
+		return err
+	}
+
+	// the certificate may have been replaced by hand
+	notifyCertificate()
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	handlers := []string{"api.example.com/"}
+	config.API.Handlers = handlers
+	defer func() { config.API.Handlers = nil }()
+	defer setHashes(nil)
+
+	t.Chdir(t.TempDir())
+	err := os.WriteFile("config.json", []byte(`{"api": {
+		"handlers": ["other.example.com/"],
+		"hashes":   ["SHA-256"]
+	}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if !hashAllowed(crypto.SHA256) || hashAllowed(crypto.SHA384) {
+		t.Error("hashes not reloaded")
+	}
+	// handlers can't be reloaded, and are read concurrently
+	if !slices.Equal(handlers, []string{"api.example.com/"}) {
+		t.Errorf("handlers changed: %q", handlers)
+	}
+
+	err = os.WriteFile("config.json", []byte(`{"api": {"hashes": ["SHA-42"]}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(); err == nil {
+		t.Error("reloaded an unsupported hash")
+	}
+}
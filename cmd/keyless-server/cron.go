@@ -3,32 +3,54 @@ package main
 import (
 	"context"
 	"crypto"
+	"crypto/x509"
 	"fmt"
 	"log"
 	"math/rand"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mholt/acmez"
 	"github.com/mholt/acmez/acme"
 )
 
+// Certificates are renewed when they expire within this window.
+const renewalWindow = 30 * 24 * time.Hour
+
+var nextRenewalCheck struct {
+	sync.Mutex
+	time.Time
+}
+
+// Returns when a certificate is expected to be renewed.
+func nextRenewal(leaf *x509.Certificate) time.Time {
+	nextRenewalCheck.Lock()
+	next := nextRenewalCheck.Time
+	nextRenewalCheck.Unlock()
+
+	if renew := leaf.NotAfter.Add(-renewalWindow); renew.After(next) {
+		return renew
+	}
+	return next
+}
+
 func renewCertificates() {
 	for {
 		client := &acmez.Client{Client: &acme.Client{}}
 		client.ChallengeSolvers = solvers.GetDNSSolvers()
-		err := renewCertificate(client, config.Certificate, config.MasterKey, "*."+config.Domain)
+		err := renewCertificate(client, "wildcard", config.Certificate, config.MasterKey, "*."+config.Domain)
 		if err != nil {
 			log.Print(err)
 		}
+		notifyCertificate()
 
-		if i := strings.IndexByte(config.API.Handler, '/'); i > 0 {
-			hostname := config.API.Handler[:i]
+		if hostnames := apiHostnames(); len(hostnames) > 0 {
 			client.ChallengeSolvers = solvers.GetAPISolvers()
-			err := renewCertificate(client, config.API.Certificate, config.API.Key, hostname)
+			err := renewCertificate(client, "api", config.API.Certificate, config.API.Key, hostnames...)
 			if err != nil {
 				log.Print(err)
-			} else if cert, err := loadCertificate(config.API.Certificate, config.API.Key, hostname); err != nil {
+			} else if cert, err := loadCertificate(config.API.Certificate, config.API.Key, hostnames...); err != nil {
 				log.Print(err)
 			} else {
 				httpCert.Lock()
@@ -37,17 +59,23 @@ func renewCertificates() {
 			}
 		}
 
-		time.Sleep(2*time.Hour + time.Duration(rand.Intn(60))*time.Minute)
+		sleep := 2*time.Hour + time.Duration(rand.Intn(60))*time.Minute
+		nextRenewalCheck.Lock()
+		nextRenewalCheck.Time = time.Now().Add(sleep)
+		nextRenewalCheck.Unlock()
+		time.Sleep(sleep)
 	}
 }
 
-func renewCertificate(client *acmez.Client, certFile, keyFile, hostname string) error {
-	cert, err := loadCertificate(certFile, keyFile, hostname)
+func renewCertificate(client *acmez.Client, name, certFile, keyFile string, hostnames ...string) (err error) {
+	cert, err := loadCertificate(certFile, keyFile)
 	if err != nil {
 		return err
 	}
 
-	if time.Until(cert.Leaf.NotAfter) > 30*24*time.Hour {
+	// renew certificates about to expire, or missing hostnames
+	missing := verifyCertificate(&cert, hostnames...)
+	if missing == nil && time.Until(cert.Leaf.NotAfter) > renewalWindow {
 		return nil
 	}
 
@@ -64,6 +92,12 @@ func renewCertificate(client *acmez.Client, certFile, keyFile, hostname string)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 	defer cancel()
 
-	log.Println("renewing the certificate for", hostname)
-	return obtainCertificate(ctx, client, acct, key, certFile, hostname)
+	log.Println("renewing the certificate for", strings.Join(hostnames, ", "))
+	err = obtainCertificate(ctx, client, acct, key, certFile, hostnames...)
+	if err != nil {
+		acmeRenewals.inc(name, "failure")
+	} else {
+		acmeRenewals.inc(name, "success")
+	}
+	return err
 }
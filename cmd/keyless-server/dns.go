@@ -1,9 +1,12 @@
 package main
 
 import (
+	"encoding/binary"
 	"errors"
+	"io"
 	"net"
 	"strings"
+	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
 )
@@ -35,46 +38,117 @@ func dnsServe(conn net.PacketConn) error {
 			continue
 		}
 
-		var parser dnsmessage.Parser
-		header, err := parser.Start(buf[:n])
+		out, err := dnsAnswer(buf[:n], 512)
 		if err != nil {
 			logError(err)
 			continue
 		}
+		_, err = conn.WriteTo(out, addr)
+		logError(err)
+	}
+}
 
-		var res response
-		res.header.ID = header.ID
-		res.header.Response = true
-		res.header.OpCode = header.OpCode
-		res.header.Authoritative = true
-		res.header.RecursionDesired = header.RecursionDesired
-
-		// only QUERY is implemented
-		if header.OpCode != 0 {
-			res.header.RCode = dnsmessage.RCodeNotImplemented
-			logError(res.send(conn, addr, buf[:0]))
-			continue
+// Most concurrent DNS over TCP connections;
+// more wait to be accepted.
+const dnsMaxConns = 256
+
+// Serves DNS over TCP, for clients that retry truncated answers.
+func dnsServeTCP(ln net.Listener) error {
+	sem := make(chan struct{}, dnsMaxConns)
+	var delay time.Duration
+	for {
+		sem <- struct{}{}
+		conn, err := ln.Accept()
+		if err != nil {
+			<-sem
+			// like net/http, back off on errors like EMFILE
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Temporary() {
+				delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+				logError(err)
+				time.Sleep(delay)
+				continue
+			}
+			return err
 		}
+		delay = 0
+		go func() {
+			defer func() { <-sem }()
+			dnsServeConn(conn)
+		}()
+	}
+}
 
-		question, err := parser.Question()
-		// refuse zero questions
-		if err == dnsmessage.ErrSectionDone {
-			res.header.RCode = dnsmessage.RCodeRefused
-			logError(res.send(conn, addr, buf[:0]))
-			continue
+func dnsServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	var buf [65535]byte
+	for {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		// messages are prefixed with their length
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
 		}
-		// report error
+		n := int(binary.BigEndian.Uint16(buf[:2]))
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return
+		}
+
+		out, err := dnsAnswer(buf[:n], len(buf))
 		if err != nil {
-			res.header.RCode = dnsmessage.RCodeFormatError
-			logError(res.send(conn, addr, buf[:0]))
-			continue
+			logError(err)
+			return
+		}
+		out = append(binary.BigEndian.AppendUint16(nil, uint16(len(out))), out...)
+		if _, err := conn.Write(out); err != nil {
+			return
 		}
-		// answer the first question only, ingore everything else
-		res.header.RCode = res.answerQuestion(question)
-		logError(res.send(conn, addr, buf[:0]))
 	}
 }
 
+// Answers a DNS query, truncating answers longer than size.
+// Returns an error only for messages that should be dropped.
+func dnsAnswer(msg []byte, size int) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var res response
+	res.header.ID = header.ID
+	res.header.Response = true
+	res.header.OpCode = header.OpCode
+	res.header.Authoritative = true
+	res.header.RecursionDesired = header.RecursionDesired
+
+	// only QUERY is implemented
+	if header.OpCode != 0 {
+		res.header.RCode = dnsmessage.RCodeNotImplemented
+		observeDNS(dnsmessage.Question{}, res.header.RCode)
+		return res.pack(nil, size)
+	}
+
+	question, err := parser.Question()
+	// refuse zero questions
+	if err == dnsmessage.ErrSectionDone {
+		res.header.RCode = dnsmessage.RCodeRefused
+		observeDNS(dnsmessage.Question{}, res.header.RCode)
+		return res.pack(nil, size)
+	}
+	// report error
+	if err != nil {
+		res.header.RCode = dnsmessage.RCodeFormatError
+		observeDNS(dnsmessage.Question{}, res.header.RCode)
+		return res.pack(nil, size)
+	}
+	// answer the first question only, ingore everything else
+	res.header.RCode = res.answerQuestion(question)
+	observeDNS(question, res.header.RCode)
+	return res.pack(nil, size)
+}
+
 type response struct {
 	header   dnsmessage.Header
 	question dnsmessage.Question
@@ -203,40 +277,40 @@ func (r *response) answerQuestion(question dnsmessage.Question) dnsmessage.RCode
 	return dnsmessage.RCodeNameError
 }
 
-func (r *response) send(conn net.PacketConn, addr net.Addr, buf []byte) error {
+// Builds the response message, appending to buf,
+// and truncating it if longer than size.
+func (r *response) pack(buf []byte, size int) ([]byte, error) {
 	builder := dnsmessage.NewBuilder(buf, r.header)
 	builder.EnableCompression()
 
 	err := r.sendQuestion(&builder)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = r.sendAnswer(&builder)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = r.sendAuthority(&builder)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	out, err := builder.Finish()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	out = convertTXTtoCAA(out)
 
 	// truncate
-	if len(out) > 512 {
-		out = out[:512]
+	if len(out) > size {
+		out = out[:size]
 		out[2] |= 2
 	}
-
-	_, err = conn.WriteTo(out, addr)
-	return err
+	return out, nil
 }
 
 func (r *response) sendQuestion(builder *dnsmessage.Builder) error {
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDNSServeConn(t *testing.T) {
+	config.Domain = "ip.example.com"
+	defer func() { config.Domain = "" }()
+
+	name := dnsmessage.MustNewName("192-168-1-1.ip.example.com.")
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 42},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, s := net.Pipe()
+	defer c.Close()
+	go dnsServeConn(s)
+
+	if _, err := c.Write(binary.BigEndian.AppendUint16(nil, uint16(len(query)))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(query); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf [512]byte
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		t.Fatal(err)
+	}
+	n := binary.BigEndian.Uint16(buf[:2])
+	if _, err := io.ReadFull(c, buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+
+	var res dnsmessage.Message
+	if err := res.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if res.ID != 42 || res.RCode != dnsmessage.RCodeSuccess || len(res.Answers) != 1 {
+		t.Fatalf("unexpected response %+v", res)
+	}
+	if a, ok := res.Answers[0].Body.(*dnsmessage.AResource); !ok || a.A != [4]byte{192, 168, 1, 1} {
+		t.Errorf("unexpected answer %v", res.Answers[0].Body)
+	}
+}
+
+func TestDNSServeTCP_temporary(t *testing.T) {
+	ln := &failingListener{errs: []error{temporaryError{}, temporaryError{}, net.ErrClosed}}
+	if err := dnsServeTCP(ln); err != net.ErrClosed {
+		t.Errorf("got %v, wanted %v", err, net.ErrClosed)
+	}
+	if len(ln.errs) != 0 {
+		t.Error("returned on a temporary error")
+	}
+}
+
+type failingListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	err := l.errs[0]
+	l.errs = l.errs[1:]
+	return nil, err
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
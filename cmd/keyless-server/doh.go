@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Returns the DNS over HTTPS server: with the API certificate,
+// but on its own listener, as it doesn't authenticate clients.
+// Like DNS over UDP, it isn't rate limited.
+func dohInit(api *tls.Config) *http.Server {
+	cfg := api.Clone()
+	cfg.NextProtos = []string{"h2", "http/1.1"}
+	cfg.ClientAuth = tls.NoClientCert
+	cfg.ClientCAs = nil
+	cfg.VerifyPeerCertificate = nil
+
+	var mux http.ServeMux
+	for _, h := range apiHandlers() {
+		mux.Handle(path.Clean(h+"/dns-query"), http.HandlerFunc(dohHandler))
+	}
+
+	return &http.Server{
+		Handler:      &mux,
+		TLSConfig:    cfg,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  10 * time.Minute,
+	}
+}
+
+// Serves DNS over HTTPS (RFC 8484) for our zone,
+// so resolvers can bypass networks that filter private addresses.
+// Errors are plain text, as DoH clients aren't API clients.
+func dohHandler(w http.ResponseWriter, r *http.Request) {
+	var msg []byte
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		var err error
+		param := strings.TrimRight(r.URL.Query().Get("dns"), "=")
+		msg, err = base64.RawURLEncoding.DecodeString(param)
+		if err != nil || len(msg) == 0 {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+
+	case http.MethodPost:
+		ct, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+		if !strings.EqualFold(strings.TrimSpace(ct), "application/dns-message") {
+			http.Error(w, "Content-Type must be application/dns-message", http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		msg, err = io.ReadAll(http.MaxBytesReader(w, r.Body, 65535))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	out, err := dnsAnswer(msg, 65535)
+	if err != nil {
+		http.Error(w, "invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	if ttl, ok := dohMaxAge(out); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(out)
+}
+
+// Returns the smallest TTL of the records in a response,
+// which is how long it can be cached.
+func dohMaxAge(msg []byte) (uint32, bool) {
+	var res dnsmessage.Message
+	if err := res.Unpack(msg); err != nil {
+		return 0, false
+	}
+
+	var ttl uint32
+	var ok bool
+	for _, rr := range append(res.Answers, res.Authorities...) {
+		if !ok || rr.Header.TTL < ttl {
+			ttl, ok = rr.Header.TTL, true
+		}
+	}
+	return ttl, ok
+}
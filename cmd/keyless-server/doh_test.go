@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDoHHandler(t *testing.T) {
+	config.Domain = "ip.example.com"
+	defer func() { config.Domain = "" }()
+
+	name := dnsmessage.MustNewName("192-168-1-1.ip.example.com.")
+	query, err := (&dnsmessage.Message{
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := httptest.NewRequest("GET", "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+	post := httptest.NewRequest("POST", "/dns-query", bytes.NewReader(query))
+	post.Header.Set("Content-Type", "application/dns-message")
+
+	for _, req := range []*http.Request{get, post} {
+		t.Run(req.Method, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			dohHandler(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d: %s", w.Code, w.Body)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/dns-message" {
+				t.Errorf("got Content-Type %q", ct)
+			}
+			if w.Header().Get("Cache-Control") == "" {
+				t.Error("missing Cache-Control")
+			}
+
+			var res dnsmessage.Message
+			if err := res.Unpack(w.Body.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			if res.RCode != dnsmessage.RCodeSuccess || len(res.Answers) != 1 {
+				t.Fatalf("unexpected response %+v", res)
+			}
+			if a, ok := res.Answers[0].Body.(*dnsmessage.AResource); !ok || a.A != [4]byte{192, 168, 1, 1} {
+				t.Errorf("unexpected answer %v", res.Answers[0].Body)
+			}
+		})
+	}
+
+	bad := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"missing parameter", httptest.NewRequest("GET", "/dns-query", nil), http.StatusBadRequest},
+		{"content type", httptest.NewRequest("POST", "/dns-query", bytes.NewReader(query)), http.StatusUnsupportedMediaType},
+		{"method", httptest.NewRequest("PUT", "/dns-query", nil), http.StatusMethodNotAllowed},
+	}
+	for _, tt := range bad {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			dohHandler(w, tt.req)
+			if w.Code != tt.status {
+				t.Errorf("got %d, wanted %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestDoHInit(t *testing.T) {
+	config.API.Handler = "keyless.example.com/"
+	defer func() { config.API.Handler = "" }()
+
+	srv := dohInit(&tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  x509.NewCertPool(),
+	})
+	if srv.TLSConfig.ClientAuth != tls.NoClientCert {
+		t.Errorf("got %v, wanted no client certificates", srv.TLSConfig.ClientAuth)
+	}
+
+	// only DNS over HTTPS is served
+	for path, want := range map[string]int{
+		"/dns-query": http.StatusBadRequest,
+		"/sign":      http.StatusNotFound,
+		"/healthz":   http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(w, httptest.NewRequest("GET", "https://keyless.example.com"+path, nil))
+		if w.Code != want {
+			t.Errorf("%s: got %d, wanted %d", path, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Default validity of enrolled client certificates.
+const enrollValidity = 7 * 24 * time.Hour
+
+// The intermediate CA that issues client certificates, if enrollment is enabled.
+var enrollCA *tls.Certificate
+
+func loadEnrollCA() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(config.API.Enroll.Certificate, config.API.Enroll.Key)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := cert.PrivateKey.(crypto.Signer); !ok {
+		return nil, errors.New("unsupported CA key")
+	}
+	if !cert.Leaf.IsCA || cert.Leaf.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return nil, errors.New("not a CA certificate")
+	}
+	return &cert, nil
+}
+
+// Enrolled certificates carry the ID of their installation in a URI SAN:
+// the serial number of its first certificate, which renewals keep,
+// so revoking that serial revokes every renewal.
+const installationURN = "keyless:installation:"
+
+// Returns the installation ID of a certificate issued by the enrollment CA.
+func installationID(cert *x509.Certificate) string {
+	if enrollCA == nil || !bytes.Equal(cert.RawIssuer, enrollCA.Leaf.RawSubject) {
+		return ""
+	}
+	for _, u := range cert.URIs {
+		if id, ok := strings.CutPrefix(u.Opaque, installationURN); ok && u.Scheme == "urn" {
+			return id
+		}
+	}
+	return ""
+}
+
+// Issues a client certificate for a certificate signing request.
+// The subject is that of the authenticated client: the subject of its
+// certificate, when renewing, or its bearer token client ID.
+func enrollHandler(w http.ResponseWriter, r *http.Request) {
+	if enrollCA == nil {
+		sendError(w, r, newAPIError(http.StatusNotFound, codeNotFound, "enrollment is not enabled"))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		sendError(w, r, newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, ""))
+		return
+	}
+	if !checkContentType(w, r, "application/pkcs10") {
+		return
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, 16*1024))
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	if block, _ := pem.Decode(buf); block != nil {
+		buf = block.Bytes
+	}
+	csr, err := x509.ParseCertificateRequest(buf)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		auditResult(r, "invalid CSR")
+		sendError(w, r, newAPIError(http.StatusBadRequest, codeInvalidRequest, "invalid certificate request"))
+		return
+	}
+
+	cert, err := issueClientCertificate(getClient(r), csr.PublicKey)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	auditResult(r, "enrolled serial "+cert.SerialNumber.Text(16)+" of installation "+installationID(cert))
+
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	for _, ca := range enrollCA.Certificate {
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca})
+	}
+}
+
+func issueClientCertificate(client apiClient, pub any) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	validity := enrollValidity
+	if config.API.Enroll.Validity > 0 {
+		validity = time.Duration(config.API.Enroll.Validity) * time.Hour
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if template.NotAfter.After(enrollCA.Leaf.NotAfter) {
+		template.NotAfter = enrollCA.Leaf.NotAfter
+	}
+	id := serial.Text(16)
+	if client.Cert != nil {
+		// renewals of revoked installations must fail,
+		// even if the certificate was accepted
+		if checkRevoked([][]*x509.Certificate{{client.Cert}}) != nil {
+			return nil, newAPIError(http.StatusUnauthorized, codeUnauthorized, "revoked certificate")
+		}
+		if prev := installationID(client.Cert); prev != "" {
+			id = prev
+		}
+		template.Subject = client.Cert.Subject
+	} else if client.ID != "" {
+		template.Subject = pkix.Name{CommonName: client.ID}
+	} else {
+		return nil, newAPIError(http.StatusUnauthorized, codeUnauthorized, "")
+	}
+	template.URIs = []*url.URL{{Scheme: "urn", Opaque: installationURN + id}}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, enrollCA.Leaf, pub,
+		enrollCA.PrivateKey.(crypto.Signer))
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidRequest, err.Error())
+	}
+	return x509.ParseCertificate(der)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEnrollHandler(t *testing.T) {
+	key, leaf := setTestEnrollCA(t)
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "admin"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enroll := func(client apiClient, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v2/enroll", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/pkcs10")
+		ctx := context.WithValue(req.Context(), v2Key{}, true)
+		ctx = context.WithValue(ctx, apiClientKey{}, client)
+		w := httptest.NewRecorder()
+		enrollHandler(w, req.WithContext(ctx))
+		return w
+	}
+
+	tests := []struct {
+		name   string
+		client apiClient
+		want   string
+	}{
+		{"token", apiClient{ID: "installation-1"}, "CN=installation-1"},
+		{"renewal", apiClient{ID: "CN=app1", Cert: &x509.Certificate{Subject: pkix.Name{CommonName: "app1"}}}, "CN=app1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := enroll(tt.client, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d: %s", w.Code, w.Body)
+			}
+
+			block, _ := pem.Decode(w.Body.Bytes())
+			if block == nil {
+				t.Fatal("no certificate")
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cert.Subject.String(); got != tt.want {
+				t.Errorf("got subject %q, wanted %q", got, tt.want)
+			}
+			if cert.NotAfter.After(leaf.NotAfter) {
+				t.Error("outlives the CA")
+			}
+
+			pool := x509.NewCertPool()
+			pool.AddCert(leaf)
+			_, err = cert.Verify(x509.VerifyOptions{
+				Roots:     pool,
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	if w := enroll(apiClient{ID: "installation-1"}, []byte("garbage")); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d, wanted 400", w.Code)
+	}
+}
+
+func TestEnrollHandler_revoked(t *testing.T) {
+	key, _ := setTestEnrollCA(t)
+	defer revocations.Store(nil)
+
+	// enroll, then renew twice
+	first, err := issueClientCertificate(apiClient{ID: "installation-1"}, key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed := first
+	for range 2 {
+		renewed, err = issueClientCertificate(apiClient{Cert: renewed}, key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id := installationID(renewed)
+	if want := first.SerialNumber.Text(16); id != want {
+		t.Errorf("got installation %q, wanted %q", id, want)
+	}
+	if renewed.SerialNumber.Cmp(first.SerialNumber) == 0 {
+		t.Error("reused the serial number")
+	}
+
+	// revoking the first serial revokes every renewal
+	revocations.Store(&revocationList{serials: map[string]bool{id: true}})
+	if checkRevoked([][]*x509.Certificate{{renewed}}) == nil {
+		t.Error("renewal not revoked with its installation")
+	}
+	if _, err := issueClientCertificate(apiClient{Cert: renewed}, key.Public()); err == nil {
+		t.Error("revoked installation renewed")
+	}
+}
+
+// Sets enrollCA to a new CA, until the test ends.
+func setTestEnrollCA(t *testing.T) (*ecdsa.PrivateKey, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "enrollment CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enrollCA = &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	t.Cleanup(func() { enrollCA = nil })
+	return key, leaf
+}
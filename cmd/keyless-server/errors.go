@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Error codes of the v2 API.
+const (
+	codeInvalidRequest   = "invalid_request"
+	codeInvalidHash      = "invalid_hash"
+	codeInvalidDigest    = "invalid_digest"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeKeyNotFound      = "key_not_found"
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeUnsupportedMedia = "unsupported_media_type"
+	codeRateLimited      = "rate_limited"
+	codeOverloaded       = "overloaded"
+	codeInternal         = "internal"
+)
+
+// An API error.
+// The legacy API sends only the message, as plain text;
+// the v2 API sends it as JSON.
+type apiError struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func newAPIError(status int, code, message string) *apiError {
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	return &apiError{
+		Status:    status,
+		Code:      code,
+		Message:   message,
+		Retryable: status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable,
+	}
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// Converts an error into an API error,
+// hiding the details of unexpected errors.
+func toAPIError(err error) *apiError {
+	var e *apiError
+	if errors.As(err, &e) {
+		return e
+	}
+	return newAPIError(http.StatusInternalServerError, codeInternal, "")
+}
+
+// Responds to a request with an error.
+func sendError(w http.ResponseWriter, r *http.Request, err error) {
+	e := *toAPIError(err)
+	if e.Retryable && w.Header().Get("Retry-After") == "" {
+		w.Header().Set("Retry-After", "1")
+	}
+
+	if !isV2(r) {
+		http.Error(w, e.Message, e.Status)
+		return
+	}
+
+	e.RequestID = requestID(r)
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(struct {
+		Error *apiError `json:"error"`
+	}{&e})
+}
+
+type requestIDKey struct{}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// Assigns an ID to each request, echoed in the X-Request-Id header.
+// Clients may provide their own, to correlate requests with the audit log.
+func requestIDHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if !validRequestID(id) {
+			var buf [12]byte
+			rand.Read(buf[:])
+			id = hex.EncodeToString(buf[:])
+		}
+
+		w.Header().Set("X-Request-Id", id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range []byte(id) {
+		switch {
+		case 'a' <= c && c <= 'z':
+		case 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9':
+		case c == '-' || c == '_' || c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+type v2Key struct{}
+
+func isV2(r *http.Request) bool {
+	return r.Context().Value(v2Key{}) != nil
+}
+
+// Serves a handler under the v2 API.
+func v2Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), v2Key{}, true)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Handles both the legacy and v2 API endpoints, under every API handler.
+func handleAPI(mux *http.ServeMux, pattern string, handler http.Handler) {
+	for _, h := range apiHandlers() {
+		mux.Handle(path.Clean(h+pattern), handler)
+		mux.Handle(path.Clean(h+"/v2"+pattern), v2Handler(handler))
+	}
+}
+
+// Responds to unknown v2 endpoints with JSON errors,
+// so clients can tell them from servers without a v2 API.
+func v2NotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	sendError(w, r, newAPIError(http.StatusNotFound, codeNotFound, ""))
+}
+
+// Checks the Content-Type of a v2 request, or responds with an error.
+// Legacy requests are not checked.
+func checkContentType(w http.ResponseWriter, r *http.Request, mediaType string) bool {
+	if !isV2(r) {
+		return true
+	}
+	ct, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	if strings.EqualFold(strings.TrimSpace(ct), mediaType) {
+		return true
+	}
+	sendError(w, r, newAPIError(http.StatusUnsupportedMediaType, codeUnsupportedMedia,
+		"Content-Type must be "+mediaType))
+	return false
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSendError(t *testing.T) {
+	handler := requestIDHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sendError(w, r, newAPIError(http.StatusTooManyRequests, codeRateLimited, ""))
+	}))
+
+	// legacy
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/sign", nil))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("got %d, %v", w.Code, w.Header())
+	}
+	if body := strings.TrimSpace(w.Body.String()); body != "Too Many Requests" {
+		t.Errorf("got %q", body)
+	}
+	if w.Header().Get("X-Request-Id") == "" {
+		t.Error("missing request ID")
+	}
+
+	// v2
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/v2/sign", nil)
+	req.Header.Set("X-Request-Id", "abc-123")
+	requestIDHandler(v2Handler(handler)).ServeHTTP(w, req)
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	if id := w.Header().Get("X-Request-Id"); id != "abc-123" {
+		t.Errorf("got request ID %q", id)
+	}
+
+	var body struct{ Error apiError }
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error.Code != codeRateLimited || !body.Error.Retryable || body.Error.RequestID != "abc-123" {
+		t.Errorf("got %+v", body.Error)
+	}
+
+	// unexpected errors are hidden
+	if e := toAPIError(errors.New("secret")); e.Status != http.StatusInternalServerError || e.Message == "secret" {
+		t.Errorf("got %+v", e)
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	for _, id := range []string{"", "a b", "a\nb", strings.Repeat("a", 65)} {
+		if validRequestID(id) {
+			t.Errorf("accepted %q", id)
+		}
+	}
+	for _, id := range []string{"a", "0f3c-AB_9.x", strings.Repeat("a", 64)} {
+		if !validRequestID(id) {
+			t.Errorf("rejected %q", id)
+		}
+	}
+}
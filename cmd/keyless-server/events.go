@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Maximum number of clients subscribed to events.
+const maxSubscribers = 1024
+
+// How often idle event streams send a comment, to keep them alive.
+const keepAliveInterval = 30 * time.Second
+
+// A certificate event, sent when the certificate
+// (and possibly the key it uses) changes.
+type certificateEvent struct {
+	Serial   string    `json:"serial"`
+	KeyID    string    `json:"key_id"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+var events struct {
+	sync.Mutex
+	last   certificateEvent
+	subs   map[chan certificateEvent]struct{}
+	closed bool
+}
+
+// Returns the current certificate event, and
+// subscribes to changes until cancel is called.
+// The channel is closed if the server shuts down.
+func subscribeEvents() (current certificateEvent, ch chan certificateEvent, cancel func()) {
+	events.Lock()
+	defer events.Unlock()
+	if events.closed || len(events.subs) >= maxSubscribers {
+		return current, nil, nil
+	}
+	if events.subs == nil {
+		events.subs = make(map[chan certificateEvent]struct{})
+	}
+
+	ch = make(chan certificateEvent, 1)
+	events.subs[ch] = struct{}{}
+	return events.last, ch, func() {
+		events.Lock()
+		defer events.Unlock()
+		if _, ok := events.subs[ch]; ok {
+			delete(events.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Notifies subscribers if the certificate changed since the last call.
+func notifyCertificate() {
+	leaf, err := readLeaf(config.Certificate)
+	if err != nil {
+		log.Println("events:", err)
+		return
+	}
+	id, err := keyID(leaf.PublicKey)
+	if err != nil {
+		log.Println("events:", err)
+		return
+	}
+	event := certificateEvent{
+		Serial:   leaf.SerialNumber.Text(16),
+		KeyID:    id,
+		NotAfter: leaf.NotAfter,
+	}
+
+	events.Lock()
+	defer events.Unlock()
+	if events.last == event {
+		return
+	}
+	changed := events.last.Serial != ""
+	events.last = event
+	if !changed {
+		return
+	}
+
+	log.Println("notifying", len(events.subs), "clients of a new certificate")
+	for ch := range events.subs {
+		// subscribers only care about the latest event
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- event
+	}
+}
+
+// Ends every event stream, so the server can shut down.
+func closeEvents() {
+	events.Lock()
+	defer events.Unlock()
+	events.closed = true
+	for ch := range events.subs {
+		delete(events.subs, ch)
+		close(ch)
+	}
+}
+
+// Streams certificate events with Server-Sent Events.
+// The current certificate is sent first,
+// then every time it changes.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	current, ch, cancel := subscribeEvents()
+	if ch == nil {
+		sendError(w, r, newAPIError(http.StatusServiceUnavailable, codeOverloaded, "too many subscribers"))
+		return
+	}
+	defer cancel()
+
+	rc := http.NewResponseController(w)
+	send := func(format string, args ...any) bool {
+		// the server write timeout doesn't suit long lived streams
+		rc.SetWriteDeadline(time.Now().Add(keepAliveInterval + 10*time.Second))
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	sendEvent := func(event certificateEvent) bool {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return false
+		}
+		return send("event: certificate\ndata: %s\n\n", data)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+	if current.Serial != "" && !sendEvent(current) {
+		return
+	}
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if !send(": keep-alive\n\n") {
+				return
+			}
+		case event, ok := <-ch:
+			if !ok || !sendEvent(event) {
+				return
+			}
+		}
+	}
+}
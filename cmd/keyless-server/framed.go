@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The framed signing protocol, negotiated with ALPN on the API listener,
+// carries many concurrent signatures over a single persistent connection.
+//
+// Requests are a 40 byte header, followed by length bytes of data:
+//
+//	id     uint32   // chosen by the client, echoed in the response
+//	op     uint8    // framedOpSign, or framedOpAuth
+//	hash   uint8    // crypto.Hash: 5 (SHA-256), 6 (SHA-384), or 7 (SHA-512)
+//	length uint16
+//	key    [32]byte // key ID, decoded
+//	data   []byte   // the digest to sign, or a bearer token
+//
+// Responses are an 8 byte header, followed by length bytes of data:
+//
+//	id     uint32
+//	status uint8    // framedStatusOK, or an error
+//	_      uint8
+//	length uint16
+//	data   []byte   // the signature, or the error code and message
+//
+// Clients that authenticate with a bearer token send it first, with framedOpAuth.
+// All integers are big-endian.
+const framedProtocol = "keyless/1"
+
+const (
+	framedOpSign = 1
+	framedOpAuth = 2
+)
+
+const (
+	framedStatusOK        = 0
+	framedStatusError     = 1
+	framedStatusRetryable = 2
+)
+
+var framed struct {
+	sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// Serves a connection that negotiated framedProtocol.
+func framedServe(_ *http.Server, conn *tls.Conn, _ http.Handler) {
+	framed.Lock()
+	if framed.closed {
+		framed.Unlock()
+		return
+	}
+	if framed.conns == nil {
+		framed.conns = make(map[net.Conn]struct{})
+	}
+	framed.conns[conn] = struct{}{}
+	framed.Unlock()
+
+	defer func() {
+		framed.Lock()
+		delete(framed.conns, conn)
+		framed.Unlock()
+	}()
+
+	conn.SetDeadline(time.Time{})
+	framedServeConn(conn, conn.ConnectionState())
+}
+
+// Stops reading from framed connections,
+// which are closed once their requests are answered.
+func closeFramed() {
+	framed.Lock()
+	defer framed.Unlock()
+	framed.closed = true
+	for conn := range framed.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+func framedServeConn(conn net.Conn, state tls.ConnectionState) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	var mtx sync.Mutex
+	write := func(id uint32, status byte, data []byte) {
+		msg := binary.BigEndian.AppendUint32(nil, id)
+		msg = append(msg, status, 0)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(data)))
+		msg = append(msg, data...)
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write(msg); err != nil {
+			conn.Close()
+		}
+	}
+	writeError := func(id uint32, err *apiError) {
+		status := byte(framedStatusError)
+		if err.Retryable {
+			status = framedStatusRetryable
+		}
+		write(id, status, []byte(err.Code+": "+err.Message))
+	}
+
+	// as with the API, clients authenticate with a client certificate,
+	// or a bearer token, unless neither is required
+	var client apiClient
+	authenticated := !authRequired()
+	if len(state.VerifiedChains) > 0 {
+		client.Cert = state.VerifiedChains[0][0]
+		client.ID = client.Cert.Subject.String()
+		authenticated = true
+	}
+	policy, allowed := findPolicy(client)
+	client.Policy = policy
+
+	addr := conn.RemoteAddr().String()
+	inflight := make(chan struct{}, keylessMaxInflight)
+	for {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Minute))
+
+		var header [40]byte
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return
+		}
+		id := binary.BigEndian.Uint32(header[0:])
+		data := make([]byte, binary.BigEndian.Uint16(header[6:]))
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+
+		switch header[4] {
+		case framedOpAuth:
+			if authenticated || !tokensEnabled() {
+				writeError(id, newAPIError(http.StatusBadRequest, codeInvalidRequest, "already authenticated"))
+				return
+			}
+			tokenID, err := verifyToken(string(data))
+			if err != nil {
+				writeError(id, newAPIError(http.StatusUnauthorized, codeUnauthorized, "invalid token"))
+				return
+			}
+			client.ID = tokenID
+			policy, allowed = findPolicy(client)
+			client.Policy = policy
+			authenticated = true
+			write(id, framedStatusOK, nil)
+
+		case framedOpSign:
+			if !authenticated {
+				writeError(id, newAPIError(http.StatusUnauthorized, codeUnauthorized, ""))
+				return
+			}
+			// connections may outlive a revocation
+			if checkRevoked(state.VerifiedChains) != nil {
+				writeError(id, newAPIError(http.StatusUnauthorized, codeUnauthorized, "revoked certificate"))
+				return
+			}
+			start := time.Now()
+			hash := crypto.Hash(header[5])
+			keyID := base64.RawURLEncoding.EncodeToString(header[8:40])
+			var refused *apiError
+			switch {
+			case !allowed || !policy.allowsEndpoint("sign"):
+				refused = newAPIError(http.StatusForbidden, codeForbidden, "sign not allowed by policy")
+			case !policy.allowsKey(keyID):
+				refused = newAPIError(http.StatusForbidden, codeForbidden, "key not allowed")
+			default:
+				if ok, _ := takeRateLimit(addr, client.ID, 1); !ok {
+					refused = newAPIError(http.StatusTooManyRequests, codeRateLimited, "")
+				}
+			}
+			if refused != nil {
+				auditRefused(addr, client, keyID, hash, data, refused)
+				observeSignItem(keyID, hash.String(), refused.Status, time.Since(start))
+				writeError(id, refused)
+				continue
+			}
+
+			inflight <- struct{}{}
+			wg.Add(1)
+			go func(client apiClient) {
+				defer wg.Done()
+				defer func() { <-inflight }()
+				signature, err := auditSign(ctx, addr, client, keyID, hash, data)
+				if err != nil {
+					err := toAPIError(err)
+					observeSignItem(keyID, hash.String(), err.Status, time.Since(start))
+					writeError(id, err)
+				} else {
+					observeSignItem(keyID, hash.String(), http.StatusOK, time.Since(start))
+					write(id, framedStatusOK, signature)
+				}
+			}(client)
+
+		default:
+			writeError(id, newAPIError(http.StatusBadRequest, codeInvalidRequest, "unknown op"))
+			return
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestFramedServeConn(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := keyID(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKeys[id] = key
+	defer delete(privateKeys, id)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go framedServeConn(server, tls.ConnectionState{})
+
+	roundTrip := func(reqID uint32, op byte, hash crypto.Hash, keyID string, data []byte) (byte, []byte) {
+		return framedRoundTrip(t, client, reqID, op, hash, keyID, data)
+	}
+
+	hash := sha256.Sum256([]byte("hello"))
+
+	status, signature := roundTrip(1, framedOpSign, crypto.SHA256, id, hash[:])
+	if status != framedStatusOK {
+		t.Fatalf("got status %d: %s", status, signature)
+	}
+	if !ecdsa.VerifyASN1(&key.PublicKey, hash[:], signature) {
+		t.Error("invalid signature")
+	}
+	signRequests.Lock()
+	n := signRequests.values[seriesKey([]string{id, "SHA-256", "200"})]
+	signRequests.Unlock()
+	if n != 1 {
+		t.Errorf("got %v signing requests, wanted 1", n)
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		hash crypto.Hash
+		code string
+	}{
+		{"unknown key", strings.Repeat("A", 43), crypto.SHA256, codeKeyNotFound},
+		{"unknown hash", id, 0, codeInvalidHash},
+		{"disallowed hash", id, crypto.SHA224, codeInvalidHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, res := roundTrip(2, framedOpSign, tt.hash, tt.key, hash[:])
+			if status != framedStatusError || !strings.HasPrefix(string(res), tt.code+":") {
+				t.Errorf("got status %d: %s", status, res)
+			}
+		})
+	}
+
+	// without tokens, clients are already authenticated
+	status, _ = roundTrip(3, framedOpAuth, 0, "", []byte("token"))
+	if status != framedStatusError {
+		t.Errorf("got status %d, wanted an error", status)
+	}
+}
+
+func TestFramedServeConn_audit(t *testing.T) {
+	setPolicies([]policy{{Keys: []string{"other"}}})
+	defer setPolicies(nil)
+
+	var audit bytes.Buffer
+	auditLog = &audit
+	defer func() { auditLog = nil }()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go framedServeConn(server, tls.ConnectionState{})
+
+	keyID := strings.Repeat("A", 43)
+	hash := sha256.Sum256([]byte("hello"))
+	status, res := framedRoundTrip(t, client, 1, framedOpSign, crypto.SHA256, keyID, hash[:])
+	if status != framedStatusError || !strings.HasPrefix(string(res), codeForbidden+":") {
+		t.Fatalf("got status %d: %s", status, res)
+	}
+
+	var entry auditEntry
+	if err := json.NewDecoder(&audit).Decode(&entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Status != 403 || entry.Key != keyID || entry.Result != "key not allowed" {
+		t.Errorf("got audit entry %+v", entry)
+	}
+}
+
+// Sends a framed request, and returns the status and data of its response.
+func framedRoundTrip(t *testing.T, client net.Conn, reqID uint32, op byte, hash crypto.Hash, keyID string, data []byte) (byte, []byte) {
+	msg := binary.BigEndian.AppendUint32(nil, reqID)
+	msg = append(msg, op, byte(hash))
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(data)))
+	k, _ := base64.RawURLEncoding.DecodeString(keyID)
+	msg = append(msg, make([]byte, 32)...)
+	copy(msg[8:], k)
+	if _, err := client.Write(append(msg, data...)); err != nil {
+		t.Fatal(err)
+	}
+
+	var header [8]byte
+	if _, err := io.ReadFull(client, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if got := binary.BigEndian.Uint32(header[0:]); got != reqID {
+		t.Fatalf("got ID %d, wanted %d", got, reqID)
+	}
+	res := make([]byte, binary.BigEndian.Uint16(header[6:]))
+	if _, err := io.ReadFull(client, res); err != nil {
+		t.Fatal(err)
+	}
+	return header[4], res
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The Keyless SSL binary protocol, as spoken by gokeyless (version 1.0),
+// lets TLS terminators that support it sign with our keys.
+// Messages are an 8 byte header (version, length, and ID),
+// followed by items: a tag, a 2 byte length, and data.
+
+const (
+	keylessTagDigest  = 0x01 // SHA-256 of the public key (PKIX, DER)
+	keylessTagSKI     = 0x04 // SHA-1 of the public key bits
+	keylessTagOpcode  = 0x11
+	keylessTagPayload = 0x12
+)
+
+const (
+	keylessOpRSASignMD5SHA1   = 0x02
+	keylessOpRSASignSHA512    = 0x07
+	keylessOpECDSASignSHA1    = 0x13
+	keylessOpECDSASignSHA224  = 0x14
+	keylessOpECDSASignSHA256  = 0x15
+	keylessOpECDSASignSHA384  = 0x16
+	keylessOpECDSASignSHA512  = 0x17
+	keylessOpRSAPSSSignSHA256 = 0x35
+	keylessOpRSAPSSSignSHA512 = 0x37
+	keylessOpResponse         = 0xf0
+	keylessOpPing             = 0xf1
+	keylessOpPong             = 0xf2
+	keylessOpError            = 0xff
+)
+
+const (
+	keylessErrCryptoFailed    = 0x01
+	keylessErrKeyNotFound     = 0x02
+	keylessErrVersionMismatch = 0x04
+	keylessErrBadOpcode       = 0x05
+	keylessErrFormat          = 0x07
+	keylessErrInternal        = 0x08
+)
+
+// Hashes of the ECDSA signing opcodes.
+var keylessHashes = map[byte]crypto.Hash{
+	keylessOpECDSASignSHA1:   crypto.SHA1,
+	keylessOpECDSASignSHA224: crypto.SHA224,
+	keylessOpECDSASignSHA256: crypto.SHA256,
+	keylessOpECDSASignSHA384: crypto.SHA384,
+	keylessOpECDSASignSHA512: crypto.SHA512,
+}
+
+// Concurrent requests per connection.
+const keylessMaxInflight = 64
+
+// Most concurrent connections;
+// more wait to be accepted.
+const keylessMaxConns = 256
+
+// Returns the TLS configuration of the Keyless SSL listener:
+// that of the API, but always requiring client certificates.
+func keylessTLSConfig(api *tls.Config) (*tls.Config, error) {
+	if api.ClientCAs == nil {
+		return nil, errors.New("listen.keyless requires api.client_ca or api.enroll")
+	}
+	cfg := api.Clone()
+	cfg.NextProtos = nil
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	cfg.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		// clients may not send a server name
+		httpCert.Lock()
+		defer httpCert.Unlock()
+		if len(httpCert.Certificate.Certificate) == 0 {
+			return getSelfSignedCert(httpCert.PrivateKey)
+		}
+		return httpCert.Certificate, nil
+	}
+	return cfg, nil
+}
+
+func keylessServe(ln net.Listener, cfg *tls.Config) error {
+	sem := make(chan struct{}, keylessMaxConns)
+	var delay time.Duration
+	for {
+		sem <- struct{}{}
+		conn, err := ln.Accept()
+		if err != nil {
+			<-sem
+			// like net/http, back off on errors like EMFILE
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Temporary() {
+				delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+				logError(err)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go func() {
+			defer func() { <-sem }()
+			keylessServeTLS(tls.Server(conn, cfg))
+		}()
+	}
+}
+
+func keylessServeTLS(conn *tls.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return
+	}
+
+	var client apiClient
+	client.Cert = state.VerifiedChains[0][0]
+	client.ID = client.Cert.Subject.String()
+	policy, ok := findPolicy(client)
+	client.Policy = policy
+	if !ok || !policy.allowsEndpoint("sign") {
+		entry := &auditEntry{Time: time.Now().UTC(), Address: conn.RemoteAddr().String()}
+		entry.setClient(client)
+		entry.Result = "sign not allowed by policy"
+		entry.finish(http.StatusForbidden)
+		return
+	}
+
+	keylessServeConn(conn, client, state.VerifiedChains)
+}
+
+// Serves requests from an authenticated client, concurrently,
+// until the connection is closed, or the client certificate revoked.
+func keylessServeConn(conn net.Conn, client apiClient, chains [][]*x509.Certificate) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	var mtx sync.Mutex
+	write := func(msg []byte) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write(msg); err != nil {
+			conn.Close()
+		}
+	}
+
+	inflight := make(chan struct{}, keylessMaxInflight)
+	for {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Minute))
+
+		var header [8]byte
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return
+		}
+		id := binary.BigEndian.Uint32(header[4:])
+		body := make([]byte, binary.BigEndian.Uint16(header[2:]))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		if header[0] != 1 {
+			write(keylessPack(id, keylessOpError, []byte{keylessErrVersionMismatch}))
+			return
+		}
+		// connections may outlive a revocation
+		if checkRevoked(chains) != nil {
+			return
+		}
+
+		inflight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-inflight }()
+			op, payload := keylessHandle(ctx, conn.RemoteAddr(), client, body)
+			write(keylessPack(id, op, payload))
+		}()
+	}
+}
+
+type keylessRequest struct {
+	op      byte
+	payload []byte
+	digest  []byte
+	ski     []byte
+}
+
+// Parses the items of a request; unknown items are ignored.
+func parseKeylessRequest(body []byte) (req keylessRequest, err error) {
+	var hasOp bool
+	for len(body) > 0 {
+		if len(body) < 3 {
+			return req, io.ErrUnexpectedEOF
+		}
+		tag, n := body[0], int(binary.BigEndian.Uint16(body[1:3]))
+		body = body[3:]
+		if len(body) < n {
+			return req, io.ErrUnexpectedEOF
+		}
+		data := body[:n]
+		body = body[n:]
+
+		switch tag {
+		case keylessTagOpcode:
+			if n != 1 {
+				return req, errors.New("invalid opcode")
+			}
+			req.op, hasOp = data[0], true
+		case keylessTagPayload:
+			req.payload = data
+		case keylessTagDigest:
+			req.digest = data
+		case keylessTagSKI:
+			req.ski = data
+		}
+	}
+	if !hasOp {
+		return req, errors.New("missing opcode")
+	}
+	return req, nil
+}
+
+// Handles a request, returning the opcode and payload of the response.
+func keylessHandle(ctx context.Context, addr net.Addr, client apiClient, body []byte) (byte, []byte) {
+	req, err := parseKeylessRequest(body)
+	if err != nil {
+		return keylessOpError, []byte{keylessErrFormat}
+	}
+
+	switch {
+	case req.op == keylessOpPing:
+		return keylessOpPong, req.payload
+	case req.op >= keylessOpRSASignMD5SHA1 && req.op <= keylessOpRSASignSHA512,
+		req.op >= keylessOpRSAPSSSignSHA256 && req.op <= keylessOpRSAPSSSignSHA512:
+		// all our keys are ECDSA
+		return keylessOpError, []byte{keylessErrCryptoFailed}
+	}
+	hash, ok := keylessHashes[req.op]
+	if !ok {
+		return keylessOpError, []byte{keylessErrBadOpcode}
+	}
+
+	start := time.Now()
+	keyID, ok := keylessFindKey(req.digest, req.ski)
+	if !ok || !client.Policy.allowsKey(keyID) {
+		msg := "key not found"
+		if ok {
+			msg = "key not allowed"
+		}
+		auditRefused(addr.String(), client, keyID, hash, req.payload,
+			newAPIError(http.StatusNotFound, codeKeyNotFound, msg))
+		observeSignItem(keyID, hash.String(), http.StatusNotFound, time.Since(start))
+		return keylessOpError, []byte{keylessErrKeyNotFound}
+	}
+	// the protocol has no error for this
+	if ok, _ := takeRateLimit(addr.String(), client.ID, 1); !ok {
+		auditRefused(addr.String(), client, keyID, hash, req.payload,
+			newAPIError(http.StatusTooManyRequests, codeRateLimited, ""))
+		observeSignItem(keyID, hash.String(), http.StatusTooManyRequests, time.Since(start))
+		return keylessOpError, []byte{keylessErrInternal}
+	}
+
+	signature, err := auditSign(ctx, addr.String(), client, keyID, hash, req.payload)
+	if err != nil {
+		status := toAPIError(err).Status
+		observeSignItem(keyID, hash.String(), status, time.Since(start))
+		switch status {
+		case http.StatusBadRequest:
+			return keylessOpError, []byte{keylessErrFormat}
+		case http.StatusNotFound:
+			return keylessOpError, []byte{keylessErrKeyNotFound}
+		default:
+			return keylessOpError, []byte{keylessErrInternal}
+		}
+	}
+	observeSignItem(keyID, hash.String(), http.StatusOK, time.Since(start))
+	return keylessOpResponse, signature
+}
+
+// Finds a key by the SHA-256 digest of its public key, or its SKI.
+func keylessFindKey(digest, ski []byte) (string, bool) {
+	if len(digest) == sha256.Size {
+		keyID := base64.RawURLEncoding.EncodeToString(digest)
+		if _, ok := privateKeys[keyID]; ok {
+			return keyID, true
+		}
+	}
+	if len(ski) == sha1.Size {
+		for keyID, key := range privateKeys {
+			if id, err := subjectKeyID(key.Public()); err == nil && string(id) == string(ski) {
+				return keyID, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Computes the subject key identifier of a public key,
+// as in RFC 5280, section 4.2.1.2, method (1).
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, err
+	}
+	hash := sha1.Sum(spki.PublicKey.Bytes)
+	return hash[:], nil
+}
+
+// Packs a response message.
+func keylessPack(id uint32, op byte, payload []byte) []byte {
+	body := []byte{keylessTagOpcode, 0, 1, op, keylessTagPayload}
+	body = binary.BigEndian.AppendUint16(body, uint16(len(payload)))
+	body = append(body, payload...)
+
+	msg := []byte{1, 0}
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(body)))
+	msg = binary.BigEndian.AppendUint32(msg, id)
+	return append(msg, body...)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestKeylessServeConn(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := keyID(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKeys[id] = key
+	defer delete(privateKeys, id)
+
+	digest, _ := base64.RawURLEncoding.DecodeString(id)
+	ski, err := subjectKeyID(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go keylessServeConn(server, apiClient{}, nil)
+
+	item := func(tag byte, data ...byte) []byte {
+		return append(binary.BigEndian.AppendUint16([]byte{tag}, uint16(len(data))), data...)
+	}
+	roundTrip := func(id uint32, items ...[]byte) (op byte, payload []byte) {
+		var body []byte
+		for _, i := range items {
+			body = append(body, i...)
+		}
+		msg := binary.BigEndian.AppendUint16([]byte{1, 0}, uint16(len(body)))
+		msg = binary.BigEndian.AppendUint32(msg, id)
+		if _, err := client.Write(append(msg, body...)); err != nil {
+			t.Fatal(err)
+		}
+
+		var header [8]byte
+		if _, err := io.ReadFull(client, header[:]); err != nil {
+			t.Fatal(err)
+		}
+		if got := binary.BigEndian.Uint32(header[4:]); got != id {
+			t.Fatalf("got ID %d, wanted %d", got, id)
+		}
+		res := make([]byte, binary.BigEndian.Uint16(header[2:]))
+		if _, err := io.ReadFull(client, res); err != nil {
+			t.Fatal(err)
+		}
+		req, err := parseKeylessRequest(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req.op, req.payload
+	}
+
+	hash := sha256.Sum256([]byte("hello"))
+
+	t.Run("ping", func(t *testing.T) {
+		op, payload := roundTrip(1, item(keylessTagOpcode, keylessOpPing), item(keylessTagPayload, 'h', 'i'))
+		if op != keylessOpPong || string(payload) != "hi" {
+			t.Errorf("got %#x %q", op, payload)
+		}
+	})
+
+	for name, lookup := range map[string][]byte{
+		"digest": item(keylessTagDigest, digest...),
+		"ski":    item(keylessTagSKI, ski...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			op, payload := roundTrip(2, lookup,
+				item(keylessTagOpcode, keylessOpECDSASignSHA256),
+				item(keylessTagPayload, hash[:]...),
+				item(0x20, make([]byte, 16)...)) // padding
+			if op != keylessOpResponse {
+				t.Fatalf("got %#x %x", op, payload)
+			}
+			if !ecdsa.VerifyASN1(&key.PublicKey, hash[:], payload) {
+				t.Error("invalid signature")
+			}
+		})
+	}
+
+	tests := []struct {
+		name  string
+		items [][]byte
+		code  byte
+	}{
+		{"unknown key", [][]byte{item(keylessTagSKI, make([]byte, 20)...),
+			item(keylessTagOpcode, keylessOpECDSASignSHA256), item(keylessTagPayload, hash[:]...)},
+			keylessErrKeyNotFound},
+		{"rsa", [][]byte{item(keylessTagSKI, ski...),
+			item(keylessTagOpcode, 0x05), item(keylessTagPayload, hash[:]...)},
+			keylessErrCryptoFailed},
+		{"bad opcode", [][]byte{item(keylessTagOpcode, 0x42)}, keylessErrBadOpcode},
+		{"short digest", [][]byte{item(keylessTagSKI, ski...),
+			item(keylessTagOpcode, keylessOpECDSASignSHA256), item(keylessTagPayload, hash[:20]...)},
+			keylessErrFormat},
+		{"missing opcode", [][]byte{item(keylessTagPayload)}, keylessErrFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			op, payload := roundTrip(3, tt.items...)
+			if op != keylessOpError || len(payload) != 1 || payload[0] != tt.code {
+				t.Errorf("got %#x %x, wanted error %d", op, payload, tt.code)
+			}
+		})
+	}
+}
+
+func TestKeylessHandle_rateLimit(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := keyID(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKeys[id] = key
+	defer delete(privateKeys, id)
+
+	setRateLimits(rateLimit{}, rateLimit{Rate: 0.001, Burst: 1})
+	defer setRateLimits(rateLimit{}, rateLimit{})
+
+	digest, _ := base64.RawURLEncoding.DecodeString(id)
+	hash := sha256.Sum256([]byte("hello"))
+	var body []byte
+	for _, item := range []struct {
+		tag  byte
+		data []byte
+	}{
+		{keylessTagDigest, digest},
+		{keylessTagOpcode, []byte{keylessOpECDSASignSHA256}},
+		{keylessTagPayload, hash[:]},
+	} {
+		body = binary.BigEndian.AppendUint16(append(body, item.tag), uint16(len(item.data)))
+		body = append(body, item.data...)
+	}
+
+	count := func(status string) float64 {
+		signRequests.Lock()
+		defer signRequests.Unlock()
+		return signRequests.values[seriesKey([]string{id, "SHA-256", status})]
+	}
+
+	var audit bytes.Buffer
+	auditLog = &audit
+	defer func() { auditLog = nil }()
+
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	client := apiClient{ID: "client"}
+	if op, payload := keylessHandle(t.Context(), addr, client, body); op != keylessOpResponse {
+		t.Fatalf("got %#x %x", op, payload)
+	}
+	if op, payload := keylessHandle(t.Context(), addr, client, body); op != keylessOpError {
+		t.Errorf("got %#x %x, wanted rate limited", op, payload)
+	}
+	if count("200") != 1 || count("429") != 1 {
+		t.Errorf("got %v successes and %v rate limited, wanted 1 each", count("200"), count("429"))
+	}
+
+	// both are audited
+	var statuses []int
+	for dec := json.NewDecoder(&audit); dec.More(); {
+		var entry auditEntry
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		statuses = append(statuses, entry.Status)
+	}
+	if !slices.Equal(statuses, []int{200, 429}) {
+		t.Errorf("got audited statuses %v, wanted [200 429]", statuses)
+	}
+}
+
+func TestKeylessServe_temporary(t *testing.T) {
+	ln := &failingListener{errs: []error{temporaryError{}, temporaryError{}, net.ErrClosed}}
+	if err := keylessServe(ln, &tls.Config{}); err != net.ErrClosed {
+		t.Errorf("got %v, wanted %v", err, net.ErrClosed)
+	}
+	if len(ln.errs) != 0 {
+		t.Error("returned on a temporary error")
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Certificates that expire sooner than this are unhealthy;
+// renewal should have happened long before.
+const expiryMargin = 7 * 24 * time.Hour
+
+var dnsAddr net.Addr // set before any server is started
+
+type healthCheck struct {
+	Status  string     `json:"status"`
+	Error   string     `json:"error,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+// Reports if the server is alive.
+// Liveness reuses the DNS check of the readiness report.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	dns := cachedReady().Checks["dns"]
+	var report healthReport
+	report.check("dns", func() error {
+		if dns.Status != "ok" {
+			return errors.New(dns.Error)
+		}
+		return nil
+	}, nil)
+	report.send(w)
+}
+
+// Readiness checks sign with the master key, and query DNS and the replica,
+// so their results are reused for a while.
+const readyCacheTime = 5 * time.Second
+
+var ready struct {
+	sync.Mutex
+	report  healthReport
+	checked time.Time
+}
+
+// Reports if the server is ready to serve clients.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	report := cachedReady()
+	report.send(w)
+}
+
+func cachedReady() healthReport {
+	ready.Lock()
+	defer ready.Unlock()
+	if time.Since(ready.checked) >= readyCacheTime {
+		ready.report = checkReady()
+		ready.checked = time.Now()
+	}
+	return ready.report
+}
+
+func checkReady() healthReport {
+	var report healthReport
+	report.check("dns", checkDNS, nil)
+	report.checkCertificate("certificate", func() (*x509.Certificate, error) {
+		return readLeaf(config.Certificate)
+	})
+	report.checkCertificate("api_certificate", func() (*x509.Certificate, error) {
+		httpCert.Lock()
+		defer httpCert.Unlock()
+		if httpCert.Leaf == nil {
+			return nil, errors.New("no certificate")
+		}
+		return httpCert.Leaf, nil
+	})
+	report.check("master_key", checkMasterKey, nil)
+	if config.Replica != "" {
+		report.check("replica", func() error {
+			_, err := replicaQuery("", "")
+			return err
+		}, nil)
+	}
+	return report
+}
+
+func (h *healthReport) check(name string, check func() error, expires *time.Time) {
+	if h.Checks == nil {
+		h.Checks = make(map[string]healthCheck)
+		h.Status = "ok"
+	}
+
+	res := healthCheck{Status: "ok", Expires: expires}
+	if err := check(); err != nil {
+		res.Status = "fail"
+		res.Error = err.Error()
+		h.Status = "fail"
+	}
+	h.Checks[name] = res
+}
+
+func (h *healthReport) checkCertificate(name string, get func() (*x509.Certificate, error)) {
+	leaf, err := get()
+	if err != nil {
+		h.check(name, func() error { return err }, nil)
+		return
+	}
+	h.check(name, func() error {
+		if time.Now().Before(leaf.NotBefore) {
+			return errors.New("certificate not yet valid")
+		}
+		if time.Until(leaf.NotAfter) < expiryMargin {
+			return errors.New("certificate near expiry")
+		}
+		return nil
+	}, &leaf.NotAfter)
+}
+
+func (h *healthReport) send(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if h.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
+
+// Checks that the master key can sign.
+func checkMasterKey() error {
+	key, ok := privateKeys[masterKeyID]
+	if !ok {
+		return errors.New("no master key")
+	}
+
+	digest := sha256.Sum256([]byte("keyless health check"))
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	if pub, ok := key.Public().(*ecdsa.PublicKey); ok && !ecdsa.VerifyASN1(pub, digest[:], sig) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// Checks that the DNS server answers queries.
+func checkDNS() error {
+	if dnsAddr == nil {
+		return errors.New("dns server not started")
+	}
+
+	addr, ok := dnsAddr.(*net.UDPAddr)
+	if !ok {
+		return fmt.Errorf("unexpected type %T", dnsAddr)
+	}
+
+	// query the loopback address when listening on every address
+	ip := addr.IP
+	switch {
+	case ip.To4() != nil && ip.IsUnspecified():
+		ip = net.IPv4(127, 0, 0, 1)
+	case ip == nil || ip.IsUnspecified():
+		ip = net.IPv6loopback
+	}
+
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: addr.Port})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	name, err := dnsmessage.NewName(config.Domain + ".")
+	if err != nil {
+		return err
+	}
+
+	var id [2]byte
+	rand.Read(id[:])
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(id[0])<<8 | uint16(id[1])},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  dnsmessage.TypeSOA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	buf, err := query.Pack()
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return err
+	}
+
+	var res [512]byte
+	for {
+		n, err := conn.Read(res[:])
+		if err != nil {
+			return err
+		}
+
+		var parser dnsmessage.Parser
+		header, err := parser.Start(res[:n])
+		if err != nil || header.ID != query.ID {
+			continue
+		}
+		if header.RCode != dnsmessage.RCodeSuccess {
+			return fmt.Errorf("unexpected response code %v", header.RCode)
+		}
+		return nil
+	}
+}
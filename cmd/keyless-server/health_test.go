@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthzHandler_cached(t *testing.T) {
+	ready.Lock()
+	ready.report = healthReport{Status: "fail", Checks: map[string]healthCheck{
+		"dns":         {Status: "fail", Error: "no answer"},
+		"master_key":  {Status: "fail", Error: "no master key"},
+		"certificate": {Status: "ok"},
+	}}
+	ready.checked = time.Now()
+	ready.Unlock()
+	defer func() {
+		ready.Lock()
+		ready.report, ready.checked = healthReport{}, time.Time{}
+		ready.Unlock()
+	}()
+
+	// reuses the cached DNS check, rather than querying DNS
+	w := httptest.NewRecorder()
+	healthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d, wanted 503", w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "no answer") || strings.Contains(body, "master_key") {
+		t.Errorf("got %s", body)
+	}
+}
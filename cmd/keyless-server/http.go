@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
@@ -13,7 +16,9 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mholt/acmez"
@@ -37,7 +42,8 @@ func httpInit() (*http.Server, error) {
 	httpCert.Certificate = &cert
 
 	var cfg tls.Config
-	cfg.NextProtos = []string{"h2", "http/1.1", acmez.ACMETLS1Protocol}
+	// framed first, as framed clients also offer HTTP/1.1
+	cfg.NextProtos = []string{framedProtocol, "h2", "http/1.1", acmez.ACMETLS1Protocol}
 
 	cfg.GetCertificate = func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
 		if chi.ServerName == "" {
@@ -57,75 +63,173 @@ func httpInit() (*http.Server, error) {
 		return httpCert.Certificate, nil
 	}
 
-	if config.API.ClientCA != "" {
-		cert, err := os.ReadFile(config.API.ClientCA)
-		if err != nil {
-			return nil, err
+	if config.API.ClientCA != "" || config.API.Enroll.Certificate != "" {
+		cfg.ClientCAs = x509.NewCertPool()
+		if config.API.ClientCA != "" {
+			cert, err := os.ReadFile(config.API.ClientCA)
+			if err != nil {
+				return nil, err
+			}
+			cfg.ClientCAs.AppendCertsFromPEM(cert)
+		}
+		if config.API.Enroll.Certificate != "" {
+			enrollCA, err = loadEnrollCA()
+			if err != nil {
+				return nil, fmt.Errorf("api.enroll: %w", err)
+			}
+			cfg.ClientCAs.AddCert(enrollCA.Leaf)
+		}
+		if tokensEnabled() {
+			// bearer tokens are an alternative to client certificates
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		} else {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
 		}
 
-		cfg.ClientCAs = x509.NewCertPool()
-		cfg.ClientCAs.AppendCertsFromPEM(cert)
-		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		if err := loadRevocations(); err != nil {
+			return nil, err
+		}
+		cfg.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			return checkRevoked(chains)
+		}
 	}
 
 	var mux http.ServeMux
 	mux.Handle("/.well-known/acme-challenge/", http.HandlerFunc(solvers.HandleHTTPChallenge))
-	mux.Handle(path.Clean(config.API.Handler+"/sign"), http.HandlerFunc(signingHandler))
-	mux.Handle(path.Clean(config.API.Handler+"/certificate"), http.HandlerFunc(certificateHandler))
+	handleAPI(&mux, "/sign", observeHandler(
+		auditHandler(authHandler("sign", rateLimitHandler(http.HandlerFunc(signingHandler)))), observeSign))
+	handleAPI(&mux, "/sign/batch", authHandler("sign", http.HandlerFunc(batchSigningHandler)))
+	handleAPI(&mux, "/certificate", observeHandler(
+		authHandler("certificate", http.HandlerFunc(certificateHandler)), observeCertificate))
+	handleAPI(&mux, "/certificate.json", observeHandler(
+		authHandler("certificate", http.HandlerFunc(certificateHandler)), observeCertificate))
+	handleAPI(&mux, "/keys", authHandler("keys", http.HandlerFunc(keysHandler)))
+	handleAPI(&mux, "/stats", authHandler("stats", http.HandlerFunc(statsHandler)))
+	handleAPI(&mux, "/healthz", http.HandlerFunc(healthzHandler))
+	handleAPI(&mux, "/readyz", http.HandlerFunc(readyzHandler))
+	for _, h := range apiHandlers() {
+		mux.Handle(path.Clean(h+"/v2/events"), v2Handler(
+			authHandler("events", http.HandlerFunc(eventsHandler))))
+		mux.Handle(path.Clean(h+"/v2/enroll"), v2Handler(auditHandler(
+			authHandler("enroll", rateLimitHandler(http.HandlerFunc(enrollHandler))))))
+		mux.Handle(path.Clean(h+"/v2")+"/", v2Handler(http.HandlerFunc(v2NotFoundHandler)))
+	}
 
 	server := http.Server{
-		Handler:      &mux,
+		Handler:      requestIDHandler(&mux),
 		TLSConfig:    &cfg,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  10 * time.Minute,
+		TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){
+			framedProtocol: framedServe,
+		},
 	}
+	// TLSNextProto would otherwise disable HTTP/2
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetHTTP2(true)
+	server.RegisterOnShutdown(closeEvents)
+	server.RegisterOnShutdown(closeFramed)
 
 	return &server, nil
 }
 
 func certificateHandler(w http.ResponseWriter, r *http.Request) {
+	leaf, err := readLeaf(config.Certificate)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+
+	// cache until the certificate may be renewed, but no longer than a day,
+	// as the master key may be rotated
+	maxAge := time.Until(nextRenewal(leaf))
+	maxAge = min(max(maxAge, 5*time.Minute), 24*time.Hour)
+
+	w.Header().Set("ETag", `"`+leaf.SerialNumber.Text(16)+`"`)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(maxAge.Seconds())))
+	w.Header().Add("Vary", "Accept")
+
+	if strings.HasSuffix(r.URL.Path, ".json") ||
+		strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("ETag", `"`+leaf.SerialNumber.Text(16)+`.json"`)
+		certificateJSONHandler(w, r, leaf)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/pem-certificate-chain")
 	http.ServeFile(w, r, config.Certificate)
 }
 
-func signingHandler(w http.ResponseWriter, r *http.Request) {
-	sendError := func(status int) {
-		http.Error(w, http.StatusText(status), status)
-	}
+type certificateInfo struct {
+	Chain       [][]byte  `json:"chain"`
+	KeyID       string    `json:"key_id"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	NextRenewal time.Time `json:"next_renewal"`
+}
 
-	query := r.URL.Query()
+func certificateJSONHandler(w http.ResponseWriter, r *http.Request, leaf *x509.Certificate) {
+	if match := r.Header.Get("If-None-Match"); match != "" && match == w.Header().Get("ETag") {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 
-	key, ok := privateKeys[query.Get("key")]
-	if !ok {
-		sendError(http.StatusNotFound)
+	buf, err := os.ReadFile(config.Certificate)
+	if err != nil {
+		sendError(w, r, err)
 		return
 	}
 
-	var hash crypto.Hash
-	if h := query.Get("hash"); h != "" {
-		for hash = crypto.MD4; ; hash++ {
-			if hash > crypto.BLAKE2b_512 {
-				sendError(http.StatusNotFound)
-				return
-			}
-			if hash.String() == h && hash.Available() {
-				// found
-				break
-			}
+	var info certificateInfo
+	for {
+		var block *pem.Block
+		block, buf = pem.Decode(buf)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			info.Chain = append(info.Chain, block.Bytes)
 		}
 	}
 
+	info.KeyID, err = keyID(leaf.PublicKey)
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	info.NotBefore = leaf.NotBefore
+	info.NotAfter = leaf.NotAfter
+	info.NextRenewal = nextRenewal(leaf)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+func signingHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	if !checkContentType(w, r, "application/octet-stream") {
+		return
+	}
+
 	var digest [65]byte
 	n, err := io.ReadFull(r.Body, digest[:])
-	if err != io.ErrUnexpectedEOF {
-		sendError(http.StatusBadRequest)
+	if err != io.ErrUnexpectedEOF && err != io.EOF {
+		sendError(w, r, newAPIError(http.StatusBadRequest, codeInvalidDigest, "digest too long"))
 		return
 	}
+	auditDigest(r, digest[:n])
 
-	signature, err := key.Sign(rand.Reader, digest[:n], hash)
+	if !checkKeyPolicy(w, r, query.Get("key")) {
+		return
+	}
+
+	signature, err := signDigest(r.Context(), query.Get("key"), query.Get("hash"), digest[:n])
 	if err != nil {
-		sendError(http.StatusInternalServerError)
+		auditResult(r, err.Error())
+		sendError(w, r, err)
 		return
 	}
 
@@ -133,6 +237,86 @@ func signingHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(signature)
 }
 
+// Signs a digest with a key, identified by its ID.
+// Errors are API errors, with the HTTP status code to respond with.
+func signDigest(ctx context.Context, keyID, hashName string, digest []byte) ([]byte, error) {
+	key, ok := privateKeys[keyID]
+	if !ok {
+		return nil, newAPIError(http.StatusNotFound, codeKeyNotFound, "key not found")
+	}
+
+	if hashName == "" {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidHash, "hash is required")
+	}
+	hash, ok := findHash(hashName)
+	if !ok || !hashAllowed(hash) {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidHash, "unsupported hash: "+hashName)
+	}
+	if len(digest) != hash.Size() {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidDigest,
+			fmt.Sprintf("digest length %d does not match %v (%d bytes)", len(digest), hash, hash.Size()))
+	}
+
+	var signature []byte
+	var err error
+	sign := func() { signature, err = key.Sign(rand.Reader, digest, hash) }
+
+	if signingPool == nil {
+		sign()
+	} else if perr := signingPool.run(ctx, sign); perr != nil {
+		return nil, newAPIError(http.StatusServiceUnavailable, codeOverloaded, perr.Error())
+	}
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, codeInternal, err.Error())
+	}
+	return signature, nil
+}
+
+// Hashes that can be used to sign, by default those used by TLS.
+var defaultHashes = map[crypto.Hash]bool{
+	crypto.SHA256: true,
+	crypto.SHA384: true,
+	crypto.SHA512: true,
+}
+
+// If set, replaces the default hashes.
+var allowedHashes atomic.Pointer[map[crypto.Hash]bool]
+
+func hashAllowed(hash crypto.Hash) bool {
+	if allowed := allowedHashes.Load(); allowed != nil {
+		return (*allowed)[hash]
+	}
+	return defaultHashes[hash]
+}
+
+// Sets the hashes that can be used to sign, by name, or the default ones if nil.
+func setHashes(names []string) error {
+	if names == nil {
+		allowedHashes.Store(nil)
+		return nil
+	}
+	allowed := make(map[crypto.Hash]bool)
+	for _, name := range names {
+		hash, ok := findHash(name)
+		if !ok {
+			return fmt.Errorf("api.hashes: unsupported hash: %s", name)
+		}
+		allowed[hash] = true
+	}
+	allowedHashes.Store(&allowed)
+	return nil
+}
+
+// Finds an available hash function by name.
+func findHash(name string) (crypto.Hash, bool) {
+	for hash := crypto.MD4; hash <= crypto.BLAKE2b_512; hash++ {
+		if hash.String() == name && hash.Available() {
+			return hash, true
+		}
+	}
+	return 0, false
+}
+
 func getSelfSignedCert(key crypto.PrivateKey) (*tls.Certificate, error) {
 	pk, ok := key.(*ecdsa.PrivateKey)
 	if !ok {
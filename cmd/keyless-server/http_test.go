@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"testing"
+)
+
+func TestSignDigest(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := keyID(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKeys[id] = key
+	defer delete(privateKeys, id)
+
+	tests := []struct {
+		name   string
+		key    string
+		hash   string
+		digest int
+		status int
+	}{
+		{"SHA-256", id, "SHA-256", 32, http.StatusOK},
+		{"SHA-384", id, "SHA-384", 48, http.StatusOK},
+		{"SHA-512", id, "SHA-512", 64, http.StatusOK},
+		{"unknown key", "key", "SHA-256", 32, http.StatusNotFound},
+		{"missing hash", id, "", 32, http.StatusBadRequest},
+		{"unknown hash", id, "SHA-999", 32, http.StatusBadRequest},
+		{"disallowed hash", id, "SHA-1", 20, http.StatusBadRequest},
+		{"short digest", id, "SHA-256", 20, http.StatusBadRequest},
+		{"long digest", id, "SHA-256", 48, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig, err := signDigest(context.Background(), tt.key, tt.hash, make([]byte, tt.digest))
+			status := http.StatusOK
+			if err != nil {
+				status = toAPIError(err).Status
+			}
+			if status != tt.status {
+				t.Errorf("got status %d (%v), wanted %d", status, err, tt.status)
+			}
+			if (sig == nil) == (err == nil) {
+				t.Errorf("unexpected result %x, %v", sig, err)
+			}
+		})
+	}
+}
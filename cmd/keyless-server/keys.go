@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+)
+
+type keyInfo struct {
+	ID          string          `json:"id"`
+	PublicKey   []byte          `json:"public_key"`
+	Status      string          `json:"status"`
+	Retires     *time.Time      `json:"retires,omitempty"`
+	Certificate *keyCertificate `json:"certificate,omitempty"`
+}
+
+type keyCertificate struct {
+	Serial   string    `json:"serial"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// Lists the keys that can be used to sign,
+// so clients can tell when to fetch a new certificate.
+func keysHandler(w http.ResponseWriter, r *http.Request) {
+	var retires *time.Time
+	if config.LegacyKeysRetire != "" {
+		t, err := time.Parse(time.RFC3339, config.LegacyKeysRetire)
+		if err != nil {
+			sendError(w, r, err)
+			return
+		}
+		retires = &t
+	}
+
+	var keys []keyInfo
+	for id, key := range privateKeys {
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			sendError(w, r, err)
+			return
+		}
+
+		info := keyInfo{ID: id, PublicKey: der}
+		switch {
+		case id == masterKeyID:
+			info.Status = "active"
+			if leaf, err := readLeaf(config.Certificate); err == nil {
+				info.Certificate = &keyCertificate{
+					Serial:   leaf.SerialNumber.Text(16),
+					NotAfter: leaf.NotAfter,
+				}
+			}
+		case retires != nil:
+			info.Status = "retiring"
+			info.Retires = retires
+		default:
+			info.Status = "legacy"
+		}
+		keys = append(keys, info)
+	}
+
+	// active key first
+	slices.SortFunc(keys, func(a, b keyInfo) int {
+		switch {
+		case a.ID == b.ID:
+			return 0
+		case a.ID == masterKeyID:
+			return -1
+		case b.ID == masterKeyID:
+			return +1
+		case a.ID < b.ID:
+			return -1
+		default:
+			return +1
+		}
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "max-age=300")
+	json.NewEncoder(w).Encode(struct {
+		Keys []keyInfo `json:"keys"`
+	}{keys})
+}
@@ -23,7 +23,10 @@ import (
 	"github.com/mholt/acmez/acme"
 )
 
-var privateKeys = make(map[string]crypto.Signer)
+var (
+	privateKeys = make(map[string]crypto.Signer)
+	masterKeyID string
+)
 
 const (
 	letsencryptProduction = "https://acme-v02.api.letsencrypt.org/"
@@ -57,24 +60,39 @@ func loadCertificateAndKeys() error {
 		}
 	}
 
-	for _, key := range keys {
-		der, err := x509.MarshalPKIXPublicKey(key.Public())
+	for i, key := range keys {
+		id, err := keyID(key.Public())
 		if err != nil {
 			return err
 		}
 
-		hash := sha256.Sum256(der)
-		privateKeys[base64.RawURLEncoding.EncodeToString(hash[:])] = key
+		privateKeys[id] = key
+		if i == 0 {
+			masterKeyID = id
+		}
 	}
 	return nil
 }
 
+// Key IDs are the SHA-256 of the DER encoded public key.
+func keyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(hash[:]), nil
+}
+
 func loadAPI() error {
-	var hostname string
-	if i := strings.IndexByte(config.API.Handler, '/'); i > 0 {
-		hostname = config.API.Handler[:i]
+	// only the main hostname is required,
+	// the certificate is renewed to cover the others
+	hostnames := apiHostnames()
+	if len(hostnames) > 1 {
+		hostnames = hostnames[:1]
 	}
-	_, err := loadCertificate(config.API.Certificate, config.API.Key, hostname)
+	_, err := loadCertificate(config.API.Certificate, config.API.Key, hostnames...)
 	if err != nil {
 		return err
 	}
@@ -89,7 +107,12 @@ func loadAPI() error {
 			return errors.New("could not parse client CA certificate")
 		}
 	}
-	return nil
+	if config.API.Enroll.Certificate != "" {
+		if _, err := loadEnrollCA(); err != nil {
+			return fmt.Errorf("api.enroll: %w", err)
+		}
+	}
+	return loadTokenKeys()
 }
 
 func loadAccount(client *acmez.Client) (acct acme.Account, err error) {
@@ -132,18 +155,18 @@ func loadKey(keyFile string) (*ecdsa.PrivateKey, error) {
 	return x509.ParseECPrivateKey(blk.Bytes)
 }
 
-func loadCertificate(certFile, keyFile, hostname string) (tls.Certificate, error) {
+func loadCertificate(certFile, keyFile string, hostnames ...string) (tls.Certificate, error) {
 	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
 		return tls.Certificate{}, err
 	}
-	if err := verifyCertificate(&cert, hostname); err != nil {
+	if err := verifyCertificate(&cert, hostnames...); err != nil {
 		return tls.Certificate{}, err
 	}
 	return cert, nil
 }
 
-func verifyCertificate(cert *tls.Certificate, hostname string) (err error) {
+func verifyCertificate(cert *tls.Certificate, hostnames ...string) (err error) {
 	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
 	if err != nil {
 		return err
@@ -151,8 +174,10 @@ func verifyCertificate(cert *tls.Certificate, hostname string) (err error) {
 	if now := time.Now(); now.Before(cert.Leaf.NotBefore) || now.After(cert.Leaf.NotAfter) {
 		return errors.New("expired certificate")
 	}
-	if hostname != "" {
-		return cert.Leaf.VerifyHostname(hostname)
+	for _, hostname := range hostnames {
+		if err := cert.Leaf.VerifyHostname(hostname); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+
+	"github.com/coreos/go-systemd/v22/activation"
+)
+
+// The sockets the server listens on.
+type listeners struct {
+	api     []net.Listener // TLS API
+	http    []net.Listener // plain HTTP API
+	dns     []net.PacketConn
+	dnsTCP  []net.Listener
+	replica []net.PacketConn
+
+	challenge []net.Listener // HTTP-01 challenges and redirects
+	keyless   []net.Listener // Keyless SSL binary protocol
+	doh       []net.Listener // DNS over HTTPS
+}
+
+// Names of socket-activated files (FileDescriptorName=).
+var listenerNames = []string{"api", "http", "dns", "replica", "challenge", "keyless", "doh"}
+
+// Opens the listeners: socket-activated first, then those in config.
+// Without either, the plain HTTP API and DNS listen on localhost, for testing.
+func listen() (*listeners, error) {
+	var ls listeners
+	if err := ls.activate(activation.Files(true)); err != nil {
+		return nil, fmt.Errorf("activation: %w", err)
+	}
+
+	var err error
+	listen := func(ln *[]net.Listener, network, addr string) {
+		if err == nil && len(*ln) == 0 && addr != "" {
+			var l net.Listener
+			if l, err = net.Listen(network, addr); err == nil {
+				*ln = append(*ln, l)
+			}
+		}
+	}
+	listenPacket := func(ln *[]net.PacketConn, network, addr string) {
+		if err == nil && len(*ln) == 0 && addr != "" {
+			var c net.PacketConn
+			if c, err = net.ListenPacket(network, addr); err == nil {
+				*ln = append(*ln, c)
+			}
+		}
+	}
+
+	listen(&ls.api, "tcp", config.Listen.API)
+	listen(&ls.http, "tcp", config.Listen.HTTP)
+	listenPacket(&ls.dns, "udp", config.Listen.DNS)
+	listen(&ls.dnsTCP, "tcp", config.Listen.DNS)
+	listenPacket(&ls.replica, "udp", config.Listen.Replica)
+	listen(&ls.challenge, "tcp", config.Listen.Challenge)
+	listen(&ls.keyless, "tcp", config.Listen.Keyless)
+	listen(&ls.doh, "tcp", config.Listen.DoH)
+
+	if len(ls.api) == 0 && len(ls.http) == 0 {
+		listen(&ls.http, "tcp", "localhost:8080")
+	}
+	listenPacket(&ls.dns, "udp", "localhost:5353")
+
+	if err != nil {
+		ls.close()
+		return nil, err
+	}
+	return &ls, nil
+}
+
+// Sorts socket-activated files by name, if they all have known names,
+// otherwise by position: API, DNS, and replica.
+func (ls *listeners) activate(files []*os.File) error {
+	named := len(files) > 0
+	for _, f := range files {
+		if !slices.Contains(listenerNames, f.Name()) {
+			named = false
+		}
+	}
+	if !named && len(files) > 3 {
+		return errors.New("unexpected number of files")
+	}
+
+	for i, f := range files {
+		name := f.Name()
+		if !named {
+			name = []string{"api", "dns", "replica"}[i]
+		}
+		err := ls.add(name, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (ls *listeners) add(name string, f *os.File) error {
+	switch name {
+	case "api", "http", "challenge", "keyless", "doh":
+		ln, err := net.FileListener(f)
+		if err != nil {
+			return err
+		}
+		switch name {
+		case "api":
+			ls.api = append(ls.api, ln)
+		case "http":
+			ls.http = append(ls.http, ln)
+		case "challenge":
+			ls.challenge = append(ls.challenge, ln)
+		case "keyless":
+			ls.keyless = append(ls.keyless, ln)
+		case "doh":
+			ls.doh = append(ls.doh, ln)
+		}
+
+	case "dns":
+		// DNS is served over both UDP and TCP
+		if ln, err := net.FileListener(f); err == nil {
+			ls.dnsTCP = append(ls.dnsTCP, ln)
+			return nil
+		}
+		conn, err := net.FilePacketConn(f)
+		if err != nil {
+			return err
+		}
+		ls.dns = append(ls.dns, conn)
+
+	case "replica":
+		conn, err := net.FilePacketConn(f)
+		if err != nil {
+			return err
+		}
+		ls.replica = append(ls.replica, conn)
+	}
+	return nil
+}
+
+func (ls *listeners) close() {
+	for _, ln := range ls.api {
+		ln.Close()
+	}
+	for _, ln := range ls.http {
+		ln.Close()
+	}
+	for _, ln := range ls.dnsTCP {
+		ln.Close()
+	}
+	for _, ln := range ls.challenge {
+		ln.Close()
+	}
+	for _, ln := range ls.keyless {
+		ln.Close()
+	}
+	for _, ln := range ls.doh {
+		ln.Close()
+	}
+	for _, conn := range ls.dns {
+		conn.Close()
+	}
+	for _, conn := range ls.replica {
+		conn.Close()
+	}
+}
@@ -0,0 +1,67 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestListeners_activate(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	file := func(name string, c interface{ File() (*os.File, error) }) *os.File {
+		f, err := c.File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		fd, err := syscall.Dup(int(f.Fd()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return os.NewFile(uintptr(fd), name)
+	}
+
+	t.Run("named", func(t *testing.T) {
+		var ls listeners
+		defer ls.close()
+		err := ls.activate([]*os.File{
+			file("dns", tcp.(*net.TCPListener)),
+			file("dns", udp.(*net.UDPConn)),
+			file("http", tcp.(*net.TCPListener)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ls.dnsTCP) != 1 || len(ls.dns) != 1 || len(ls.http) != 1 || len(ls.api) != 0 {
+			t.Errorf("unexpected listeners %+v", ls)
+		}
+	})
+
+	t.Run("positional", func(t *testing.T) {
+		var ls listeners
+		defer ls.close()
+		err := ls.activate([]*os.File{
+			file("keyless.socket", tcp.(*net.TCPListener)),
+			file("keyless.socket", udp.(*net.UDPConn)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ls.api) != 1 || len(ls.dns) != 1 || len(ls.replica) != 0 {
+			t.Errorf("unexpected listeners %+v", ls)
+		}
+	})
+}
@@ -9,8 +9,8 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
-	"github.com/coreos/go-systemd/v22/activation"
 	"github.com/coreos/go-systemd/v22/daemon"
 )
 
@@ -20,6 +20,11 @@ func main() {
 		interactiveSetup()
 		return
 	}
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		// print a bearer token and exit
+		printToken(os.Args[2:])
+		return
+	}
 
 	if err := loadConfig(); err != nil {
 		log.Fatalln("configuration:", err)
@@ -29,96 +34,166 @@ func main() {
 		log.Println("setup:", err)
 		log.Fatalln("please, run:", os.Args[0], "setup")
 	}
+	if err := auditInit(); err != nil {
+		log.Fatalln("audit log:", err)
+	}
+	startSigningPool()
 
 	shutdown := make(chan os.Signal, 1)
-	signal.Notify(shutdown, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			if err := reloadConfig(); err != nil {
+				log.Println("reload configuration:", err)
+			} else {
+				log.Println("reloaded configuration")
+			}
+		}
+	}()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	fs := activation.Files(true)
-	if len(fs) > 3 {
-		log.Fatalln("activation: unexpected number of files")
-	}
-
-	var httpln net.Listener
-	var dnsconn net.PacketConn
-	var replconn net.PacketConn
-	if len(fs) > 0 {
-		var err error
-		httpln, err = net.FileListener(fs[0])
-		if err != nil {
-			log.Fatalln("activation:", err)
-		}
-		fs[0].Close()
-	}
-	if len(fs) > 1 {
-		var err error
-		dnsconn, err = net.FilePacketConn(fs[1])
-		if err != nil {
-			log.Fatalln("activation:", err)
-		}
-		fs[1].Close()
-	} else {
-		var err error
-		dnsconn, err = net.ListenPacket("udp", "localhost:5353")
-		if err != nil {
-			log.Fatalln("dns server:", err)
-		}
-		defer dnsconn.Close()
-	}
-	if len(fs) > 2 {
-		var err error
-		replconn, err = net.FilePacketConn(fs[2])
-		if err != nil {
-			log.Fatalln("activation:", err)
-		}
-		fs[2].Close()
+	ls, err := listen()
+	if err != nil {
+		log.Fatalln("listen:", err)
 	}
+	dnsAddr = ls.dns[0].LocalAddr()
 
 	httpsrv, err := httpInit()
 	if err != nil {
 		log.Fatalln("http server:", err)
 	}
-	httpsrv.Addr = "localhost:8080"
 	httpsrv.BaseContext = func(_ net.Listener) context.Context { return ctx }
 
-	go func() {
-		var err error
-		if httpln == nil {
-			err = httpsrv.ListenAndServe()
-		} else {
-			err = httpsrv.ServeTLS(httpln, "", "")
+	for _, ln := range ls.api {
+		go func() {
+			err := httpsrv.ServeTLS(ln, "", "")
+			if !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalln("http server:", err)
+			}
+		}()
+	}
+	for _, ln := range ls.http {
+		go func() {
+			err := httpsrv.Serve(ln)
+			if !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalln("http server:", err)
+			}
+		}()
+	}
+
+	challengesrv := challengeInit()
+	for _, ln := range ls.challenge {
+		go func() {
+			err := challengesrv.Serve(ln)
+			if !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalln("challenge server:", err)
+			}
+		}()
+	}
+
+	dohsrv := dohInit(httpsrv.TLSConfig)
+	for _, ln := range ls.doh {
+		go func() {
+			err := dohsrv.ServeTLS(ln, "", "")
+			if !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalln("doh server:", err)
+			}
+		}()
+	}
+
+	if len(ls.keyless) > 0 {
+		cfg, err := keylessTLSConfig(httpsrv.TLSConfig)
+		if err != nil {
+			log.Fatalln("keyless server:", err)
 		}
-		if !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalln("http server:", err)
+		for _, ln := range ls.keyless {
+			go func() {
+				err := keylessServe(ln, cfg)
+				if !errors.Is(err, net.ErrClosed) {
+					log.Fatalln("keyless server:", err)
+				}
+			}()
 		}
-	}()
+	}
 
-	go func() {
-		err := dnsServe(dnsconn)
-		if errors.Is(err, net.ErrClosed) {
-			log.Fatalln("dns server:", err)
-		}
-	}()
+	for _, conn := range ls.dns {
+		go func() {
+			err := dnsServe(conn)
+			if !errors.Is(err, net.ErrClosed) {
+				log.Fatalln("dns server:", err)
+			}
+		}()
+	}
+	for _, ln := range ls.dnsTCP {
+		go func() {
+			err := dnsServeTCP(ln)
+			if !errors.Is(err, net.ErrClosed) {
+				log.Fatalln("dns server:", err)
+			}
+		}()
+	}
 
-	if replconn != nil {
+	for _, conn := range ls.replica {
 		go func() {
-			err := replicaServe(replconn)
-			if errors.Is(err, net.ErrClosed) {
+			err := replicaServe(conn)
+			if !errors.Is(err, net.ErrClosed) {
 				log.Fatalln("replica server:", err)
 			}
 		}()
 	}
 
-	daemon.SdNotify(true, daemon.SdNotifyReady)
+	if config.Metrics != "" {
+		metricsln, err := net.Listen("tcp", config.Metrics)
+		if err != nil {
+			log.Fatalln("metrics server:", err)
+		}
+		go func() {
+			err := metricsServe(metricsln)
+			log.Fatalln("metrics server:", err)
+		}()
+	}
+
+	go func() {
+		// wait for the DNS server to answer, backing off up to a minute
+		delay := time.Second
+		for err := checkDNS(); err != nil; err = checkDNS() {
+			log.Println("dns server:", err)
+			time.Sleep(delay)
+			delay = min(2*delay, time.Minute)
+		}
+		daemon.SdNotify(true, daemon.SdNotifyReady)
+	}()
 	go renewCertificates()
+	go watchRevocations()
 
 	<-shutdown
 	go func() {
 		log.Fatalln(<-shutdown)
 	}()
-	if err := dnsconn.Close(); err != nil {
-		log.Fatalln("close dns connection:", err)
+	for _, conn := range ls.dns {
+		if err := conn.Close(); err != nil {
+			log.Fatalln("close dns connection:", err)
+		}
+	}
+	for _, ln := range ls.dnsTCP {
+		if err := ln.Close(); err != nil {
+			log.Fatalln("close dns listener:", err)
+		}
+	}
+	for _, ln := range ls.keyless {
+		if err := ln.Close(); err != nil {
+			log.Fatalln("close keyless listener:", err)
+		}
+	}
+	if err := dohsrv.Shutdown(ctx); err != nil {
+		log.Fatalln("shutdown doh server:", err)
+	}
+	if err := challengesrv.Shutdown(ctx); err != nil {
+		log.Fatalln("shutdown challenge server:", err)
 	}
 	if err := httpsrv.Shutdown(ctx); err != nil {
 		log.Fatalln("shutdown http server:", err)
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Metrics, in the Prometheus text exposition format.
+var (
+	signRequests = newCounter("keyless_sign_requests_total",
+		"Signing requests by key, hash and status.", "key", "hash", "status")
+	signDuration = newHistogram("keyless_sign_duration_seconds",
+		"Signing request latency.", []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1})
+	signQueueWait = newHistogram("keyless_sign_queue_wait_seconds",
+		"Time signing requests wait in the queue.", []float64{.0001, .001, .005, .01, .05, .1, .5, 1})
+	_ = newGaugeFunc("keyless_sign_queue_depth",
+		"Signing requests waiting in the queue.", signQueueDepth)
+	certificateRequests = newCounter("keyless_certificate_requests_total",
+		"Certificate requests by status.", "status")
+	dnsQueries = newCounter("keyless_dns_queries_total",
+		"DNS queries by type and response code.", "type", "rcode")
+	acmeRenewals = newCounter("keyless_acme_renewals_total",
+		"ACME certificate renewal attempts by certificate and result.", "certificate", "result")
+	replicaRequests = newCounter("keyless_replica_requests_total",
+		"Replica requests by result.", "result")
+	_ = newGaugeFunc("keyless_certificate_expiry_days",
+		"Days until certificates expire.", certificateExpiry, "certificate")
+)
+
+var metricsRegistry []interface{ writeTo(w io.Writer) }
+
+func metricsServe(ln net.Listener) error {
+	var mux http.ServeMux
+	mux.HandleFunc("/metrics", metricsHandler)
+
+	server := http.Server{
+		Handler:      &mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	return server.Serve(ln)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buf := bufio.NewWriter(w)
+	for _, m := range metricsRegistry {
+		m.writeTo(buf)
+	}
+	buf.Flush()
+}
+
+// Observes the status and duration of requests.
+func observeHandler(handler http.Handler, observe func(r *http.Request, status int, duration time.Duration)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := statusRecorder{ResponseWriter: w}
+		handler.ServeHTTP(&rec, r)
+		observe(r, rec.status(), time.Since(start))
+	})
+}
+
+func observeSign(r *http.Request, status int, duration time.Duration) {
+	query := r.URL.Query()
+	observeSignItem(query.Get("key"), query.Get("hash"), status, duration)
+}
+
+func observeSignItem(key, hash string, status int, duration time.Duration) {
+	// avoid unbounded label values
+	if _, ok := privateKeys[key]; !ok {
+		key = "unknown"
+	}
+	if _, ok := findHash(hash); !ok {
+		hash = "unknown"
+	}
+
+	signRequests.inc(key, hash, strconv.Itoa(status))
+	signDuration.observe(duration.Seconds())
+}
+
+func observeCertificate(r *http.Request, status int, _ time.Duration) {
+	certificateRequests.inc(strconv.Itoa(status))
+}
+
+func observeDNS(question dnsmessage.Question, rcode dnsmessage.RCode) {
+	// avoid unbounded label values
+	var typ string
+	switch t := question.Type; t {
+	case 0:
+		typ = "none"
+	case dnsmessage.TypeA, dnsmessage.TypeNS, dnsmessage.TypeCNAME, dnsmessage.TypeSOA,
+		dnsmessage.TypeMX, dnsmessage.TypeTXT, dnsmessage.TypeAAAA, dnsmessage.TypeSRV,
+		dnsmessage.TypeALL:
+		typ = strings.TrimPrefix(t.String(), "Type")
+	case 257:
+		typ = "CAA"
+	default:
+		typ = "other"
+	}
+	dnsQueries.inc(typ, strings.TrimPrefix(rcode.String(), "RCode"))
+}
+
+func signQueueDepth(emit func(value float64, labels ...string)) {
+	if p := signingPool; p != nil {
+		emit(float64(len(p.queue)))
+	}
+}
+
+func certificateExpiry(emit func(value float64, labels ...string)) {
+	if leaf, err := readLeaf(config.Certificate); err == nil {
+		emit(time.Until(leaf.NotAfter).Hours()/24, "wildcard")
+	}
+
+	httpCert.Lock()
+	leaf := httpCert.Leaf
+	httpCert.Unlock()
+	if leaf != nil {
+		emit(time.Until(leaf.NotAfter).Hours()/24, "api")
+	}
+}
+
+// Reads the leaf certificate from a PEM file.
+func readLeaf(certFile string) (*x509.Certificate, error) {
+	buf, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	blk, _ := pem.Decode(buf)
+	if blk == nil || blk.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate found")
+	}
+	return x509.ParseCertificate(blk.Bytes)
+}
+
+type metric struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (m *metric) writeHeader(w io.Writer, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, typ)
+}
+
+func (m *metric) writeSample(w io.Writer, suffix string, values []string, extra string, value float64) {
+	io.WriteString(w, m.name+suffix)
+	if len(values) > 0 || extra != "" {
+		var labels []string
+		for i, v := range values {
+			labels = append(labels, m.labels[i]+`="`+labelEscaper.Replace(v)+`"`)
+		}
+		if extra != "" {
+			labels = append(labels, extra)
+		}
+		io.WriteString(w, "{"+strings.Join(labels, ",")+"}")
+	}
+	io.WriteString(w, " "+strconv.FormatFloat(value, 'g', -1, 64)+"\n")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+type counter struct {
+	metric
+	sync.Mutex
+	values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	c := &counter{metric: metric{name, help, labels}, values: make(map[string]float64)}
+	metricsRegistry = append(metricsRegistry, c)
+	return c
+}
+
+func (c *counter) inc(values ...string) {
+	c.Lock()
+	defer c.Unlock()
+	c.values[seriesKey(values)]++
+}
+
+func (c *counter) writeTo(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	c.writeHeader(w, "counter")
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		var values []string
+		if len(c.labels) > 0 {
+			values = strings.Split(k, "\xff")
+		}
+		c.writeSample(w, "", values, "", c.values[k])
+	}
+}
+
+type histogram struct {
+	metric
+	sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	h := &histogram{
+		metric:  metric{name: name, help: help},
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+	metricsRegistry = append(metricsRegistry, h)
+	return h
+}
+
+func (h *histogram) observe(value float64) {
+	h.Lock()
+	defer h.Unlock()
+	for i, b := range h.buckets {
+		if value <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+func (h *histogram) writeTo(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	h.writeHeader(w, "histogram")
+	for i, b := range h.buckets {
+		le := `le="` + strconv.FormatFloat(b, 'g', -1, 64) + `"`
+		h.writeSample(w, "_bucket", nil, le, float64(h.counts[i]))
+	}
+	h.writeSample(w, "_bucket", nil, `le="+Inf"`, float64(h.count))
+	h.writeSample(w, "_sum", nil, "", h.sum)
+	h.writeSample(w, "_count", nil, "", float64(h.count))
+}
+
+type gaugeFunc struct {
+	metric
+	collect func(emit func(value float64, labels ...string))
+}
+
+func newGaugeFunc(name, help string, collect func(emit func(value float64, labels ...string)), labels ...string) *gaugeFunc {
+	g := &gaugeFunc{metric: metric{name, help, labels}, collect: collect}
+	metricsRegistry = append(metricsRegistry, g)
+	return g
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+	g.writeHeader(w, "gauge")
+	g.collect(func(value float64, labels ...string) {
+		if !math.IsNaN(value) {
+			g.writeSample(w, "", labels, "", value)
+		}
+	})
+}
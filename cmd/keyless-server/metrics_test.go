@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	c := &counter{
+		metric: metric{"test_total", "Test counter.", []string{"a", "b"}},
+		values: make(map[string]float64),
+	}
+	c.inc("x", `y"z`)
+	c.inc("x", `y"z`)
+	c.inc("w", "")
+
+	h := &histogram{
+		metric:  metric{name: "test_seconds", help: "Test histogram."},
+		buckets: []float64{.1, 1},
+		counts:  make([]uint64, 2),
+	}
+	h.observe(.05)
+	h.observe(.5)
+	h.observe(5)
+
+	var buf strings.Builder
+	c.writeTo(&buf)
+	h.writeTo(&buf)
+
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{a="w",b=""} 1
+test_total{a="x",b="y\"z"} 2
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 5.55
+test_seconds_count 3
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwanted:\n%s", got, want)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"sync/atomic"
+)
+
+// A policy restricts the keys and endpoints matching clients may use.
+// Patterns are globs, as in path.Match; empty patterns match anything.
+type policy struct {
+	Subject   string   `json:"subject"`   // optional, client certificate subject
+	SAN       string   `json:"san"`       // optional, any DNS, email or URI SAN
+	Issuer    string   `json:"issuer"`    // optional, client certificate issuer
+	Client    string   `json:"client"`    // optional, bearer token client ID
+	Keys      []string `json:"keys"`      // optional, key IDs, or "active"
+	Endpoints []string `json:"endpoints"` // optional
+}
+
+// Endpoints that policies can allow.
+var policyEndpoints = []string{"sign", "certificate", "keys", "stats", "events", "enroll"}
+
+// If set, clients must match a policy.
+var policies atomic.Pointer[[]policy]
+
+func setPolicies(list []policy) error {
+	for i, p := range list {
+		for _, pattern := range []string{p.Subject, p.SAN, p.Issuer, p.Client} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("api.policies[%d]: %w: %q", i, err, pattern)
+			}
+		}
+		for _, e := range p.Endpoints {
+			if !slices.Contains(policyEndpoints, e) {
+				return fmt.Errorf("api.policies[%d]: unknown endpoint: %q", i, e)
+			}
+		}
+	}
+	if len(list) == 0 {
+		policies.Store(nil)
+	} else {
+		policies.Store(&list)
+	}
+	return nil
+}
+
+// Finds the first policy that matches the client.
+// Returns false if there are policies, and none matches.
+func findPolicy(client apiClient) (*policy, bool) {
+	list := policies.Load()
+	if list == nil {
+		return nil, true
+	}
+	for i := range *list {
+		if p := &(*list)[i]; p.matches(client) {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+func (p *policy) matches(client apiClient) bool {
+	if p.Client != "" && (client.Cert != nil || !match(p.Client, client.ID)) {
+		return false
+	}
+	if p.Subject == "" && p.SAN == "" && p.Issuer == "" {
+		return true
+	}
+	if client.Cert == nil {
+		return false
+	}
+	if p.Subject != "" && !match(p.Subject, client.Cert.Subject.String()) {
+		return false
+	}
+	if p.Issuer != "" && !match(p.Issuer, client.Cert.Issuer.String()) {
+		return false
+	}
+	if p.SAN != "" && !slices.ContainsFunc(certificateSANs(client.Cert), func(san string) bool {
+		return match(p.SAN, san)
+	}) {
+		return false
+	}
+	return true
+}
+
+func (p *policy) allowsEndpoint(endpoint string) bool {
+	return p == nil || len(p.Endpoints) == 0 || slices.Contains(p.Endpoints, endpoint)
+}
+
+func (p *policy) allowsKey(keyID string) bool {
+	if p == nil || len(p.Keys) == 0 {
+		return true
+	}
+	for _, k := range p.Keys {
+		if k == keyID || k == "active" && keyID == masterKeyID {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that the client may use a key, or responds with an error.
+func checkKeyPolicy(w http.ResponseWriter, r *http.Request, keyID string) bool {
+	if getClient(r).Policy.allowsKey(keyID) {
+		return true
+	}
+	auditResult(r, "key not allowed by policy")
+	sendError(w, r, newAPIError(http.StatusForbidden, codeForbidden, "key not allowed"))
+	return false
+}
+
+func certificateSANs(cert *x509.Certificate) []string {
+	sans := slices.Clone(cert.DNSNames)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+func match(pattern, name string) bool {
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	defer setPolicies(nil)
+	defer func(id string) { masterKeyID = id }(masterKeyID)
+	masterKeyID = "master"
+
+	err := setPolicies([]policy{
+		{Subject: "CN=app1", Keys: []string{"active"}, Endpoints: []string{"sign", "certificate"}},
+		{SAN: "*.example.com", Issuer: "CN=Example CA", Endpoints: []string{"certificate"}},
+		{Client: "release-*", Keys: []string{"legacy"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app1 := apiClient{Cert: &x509.Certificate{Subject: pkix.Name{CommonName: "app1"}}}
+	app2 := apiClient{Cert: &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "app2"},
+		Issuer:   pkix.Name{CommonName: "Example CA"},
+		DNSNames: []string{"app2.example.com"},
+	}}
+	token := apiClient{ID: "release-42"}
+	other := apiClient{ID: "CN=other", Cert: &x509.Certificate{Subject: pkix.Name{CommonName: "other"}}}
+
+	tests := []struct {
+		name     string
+		client   apiClient
+		endpoint string
+		key      string
+		want     bool
+	}{
+		{"subject", app1, "sign", "master", true},
+		{"subject key", app1, "sign", "legacy", false},
+		{"subject endpoint", app1, "keys", "", false},
+		{"san", app2, "certificate", "", true},
+		{"san endpoint", app2, "sign", "master", false},
+		{"token", token, "stats", "legacy", true},
+		{"token key", token, "sign", "master", false},
+		{"no match", other, "certificate", "", false},
+		{"anonymous", apiClient{}, "certificate", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, ok := findPolicy(tt.client)
+			got := ok && p.allowsEndpoint(tt.endpoint) && (tt.key == "" || p.allowsKey(tt.key))
+			if got != tt.want {
+				t.Errorf("got %v, wanted %v", got, tt.want)
+			}
+		})
+	}
+
+	if err := setPolicies([]policy{{Endpoints: []string{"unknown"}}}); err == nil {
+		t.Error("accepted an unknown endpoint")
+	}
+	if err := setPolicies([]policy{{Subject: "CN=["}}); err == nil {
+		t.Error("accepted a bad pattern")
+	}
+}
+
+func TestAuthHandler_policy(t *testing.T) {
+	defer setPolicies(nil)
+	err := setPolicies([]policy{{Subject: "CN=app1", Endpoints: []string{"certificate"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := authHandler("sign", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, cn := range []string{"app1", "app2"} {
+		req := httptest.NewRequest("POST", "/sign", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+			{Subject: pkix.Name{CommonName: cn}},
+		}}}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: got %d, wanted 403", cn, w.Code)
+		}
+	}
+}
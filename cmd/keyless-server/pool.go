@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errQueueFull    = errors.New("signing queue is full")
+	errQueueTimeout = errors.New("signing queue timeout")
+)
+
+// The pool that runs signing operations, if started.
+var signingPool *workerPool
+
+// A bounded pool of workers, with a bounded queue.
+// Jobs that wait in the queue for too long are dropped.
+type workerPool struct {
+	queue   chan *poolJob
+	workers int
+	timeout time.Duration
+
+	rejected expvar.Int
+	expired  expvar.Int
+	waited   expvar.Float // seconds
+	done     expvar.Int
+}
+
+type poolJob struct {
+	ctx     context.Context
+	fn      func()
+	queued  time.Time
+	err     chan error
+	claimed atomic.Bool // by a worker to run it, or by the caller to abandon it
+}
+
+// Starts a pool sized to GOMAXPROCS.
+func startSigningPool() {
+	workers := runtime.GOMAXPROCS(0)
+	size := config.API.Queue.Size
+	if size <= 0 {
+		size = 16 * workers
+	}
+	timeout := time.Duration(config.API.Queue.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+
+	signingPool = newWorkerPool(workers, size, timeout)
+}
+
+func newWorkerPool(workers, size int, timeout time.Duration) *workerPool {
+	p := &workerPool{
+		queue:   make(chan *poolJob, size),
+		workers: workers,
+		timeout: timeout,
+	}
+	for range workers {
+		go p.worker()
+	}
+	return p
+}
+
+func (p *workerPool) worker() {
+	for job := range p.queue {
+		if !job.claimed.CompareAndSwap(false, true) {
+			continue // abandoned
+		}
+
+		wait := time.Since(job.queued)
+		p.waited.Add(wait.Seconds())
+		p.done.Add(1)
+		signQueueWait.observe(wait.Seconds())
+
+		switch {
+		case job.ctx.Err() != nil:
+			job.err <- job.ctx.Err()
+		case wait > p.timeout:
+			p.expired.Add(1)
+			job.err <- errQueueTimeout
+		default:
+			job.fn()
+			job.err <- nil
+		}
+	}
+}
+
+// Runs fn in the pool, and waits for it to complete.
+// Fails if the queue is full, or fn waits in it for too long,
+// or ctx is done before fn starts.
+func (p *workerPool) run(ctx context.Context, fn func()) error {
+	job := &poolJob{
+		ctx:    ctx,
+		fn:     fn,
+		queued: time.Now(),
+		err:    make(chan error, 1),
+	}
+
+	select {
+	case p.queue <- job:
+	default:
+		p.rejected.Add(1)
+		return errQueueFull
+	}
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case err := <-job.err:
+		return err
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+		err = errQueueTimeout
+	}
+
+	// abandon the job, unless a worker is already running it
+	if job.claimed.CompareAndSwap(false, true) {
+		if err == errQueueTimeout {
+			p.expired.Add(1)
+		}
+		return err
+	}
+	return <-job.err
+}
+
+func (p *workerPool) stats() any {
+	if p == nil {
+		return nil
+	}
+
+	var avg float64
+	if n := p.done.Value(); n > 0 {
+		avg = p.waited.Value() / float64(n) * 1000
+	}
+	return map[string]any{
+		"workers":      p.workers,
+		"queue_size":   cap(p.queue),
+		"queue_depth":  len(p.queue),
+		"rejected":     p.rejected.Value(),
+		"expired":      p.expired.Value(),
+		"wait_avg_ms":  avg,
+		"wait_timeout": p.timeout.Milliseconds(),
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool(t *testing.T) {
+	p := newWorkerPool(1, 1, 50*time.Millisecond)
+	ctx := context.Background()
+
+	// block the only worker
+	block := make(chan struct{})
+	started := make(chan struct{})
+	go p.run(ctx, func() { close(started); <-block })
+	<-started
+
+	// fill the queue
+	queued := make(chan error)
+	go func() { queued <- p.run(ctx, func() {}) }()
+	for len(p.queue) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := p.run(ctx, func() {}); err != errQueueFull {
+		t.Errorf("got %v, wanted %v", err, errQueueFull)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	close(block)
+	if err := <-queued; err != errQueueTimeout {
+		t.Errorf("got %v, wanted %v", err, errQueueTimeout)
+	}
+
+	// the abandoned job is dropped by the worker
+	for len(p.queue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ran := false
+	if err := p.run(ctx, func() { ran = true }); err != nil || !ran {
+		t.Errorf("got %v, wanted job to run", err)
+	}
+}
+
+func TestWorkerPool_abandon(t *testing.T) {
+	p := newWorkerPool(1, 1, time.Minute)
+
+	// block the only worker
+	block := make(chan struct{})
+	started := make(chan struct{})
+	go p.run(context.Background(), func() { close(started); <-block })
+	<-started
+	defer close(block)
+
+	// a job that's cancelled while queued returns without waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	ran := false
+	if err := p.run(ctx, func() { ran = true }); err != context.Canceled {
+		t.Errorf("got %v, wanted %v", err, context.Canceled)
+	}
+	if ran {
+		t.Error("abandoned job ran")
+	}
+}
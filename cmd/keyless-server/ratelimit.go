@@ -0,0 +1,192 @@
+package main
+
+import (
+	"expvar"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type rateLimit struct {
+	Rate  float64 `json:"rate"`  // requests per second
+	Burst int     `json:"burst"` // bucket size
+}
+
+var rateLimits struct {
+	ip     limiter // keyed by client IP
+	client limiter // keyed by client identity
+}
+
+// Applies new rate limits; a zero rate disables limiting.
+func setRateLimits(ip, client rateLimit) {
+	rateLimits.ip.configure(ip)
+	rateLimits.client.configure(client)
+}
+
+// Limits the rate of requests by client IP and client identity.
+func rateLimitHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if checkRateLimit(w, r, 1) {
+			handler.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Takes n tokens for a request, or responds with an error.
+func checkRateLimit(w http.ResponseWriter, r *http.Request, n int) bool {
+	ok, retry := takeRateLimit(r.RemoteAddr, getClient(r).ID, n)
+	if !ok {
+		err := newAPIError(http.StatusTooManyRequests, codeRateLimited, "")
+		if retry > 0 {
+			secs := int(math.Ceil(retry.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+		} else {
+			err.Message = "request exceeds the rate limit burst"
+			err.Retryable = false
+		}
+		sendError(w, r, err)
+	}
+	return ok
+}
+
+// Takes n tokens for a request, by client address and client identity.
+// If there aren't enough, returns how long until there will be, or zero.
+func takeRateLimit(addr, clientID string, n int) (bool, time.Duration) {
+	ok, retry := true, time.Duration(0)
+	if ip := ipKey(addr); ip != "" {
+		ok, retry = rateLimits.ip.allow(ip, n)
+	}
+	if ok && clientID != "" {
+		ok, retry = rateLimits.client.allow(clientID, n)
+	}
+	return ok, retry
+}
+
+// Returns the rate limiting key of a client address:
+// the IP for IPv4, and the /64 prefix for IPv6,
+// which clients usually get whole.
+func ipKey(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return ""
+	}
+	ip = ip.WithZone("").Unmap()
+	if ip.Is6() {
+		prefix, _ := ip.Prefix(64)
+		return prefix.String()
+	}
+	return ip.String()
+}
+
+// The most buckets a limiter keeps;
+// new keys are denied while it's full of active ones.
+const maxBuckets = 100_000
+
+// A set of token buckets.
+type limiter struct {
+	sync.Mutex
+	limit   rateLimit
+	buckets map[string]*bucket
+	swept   time.Time
+	limited expvar.Int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (l *limiter) configure(limit rateLimit) {
+	l.Lock()
+	defer l.Unlock()
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	if l.limit != limit {
+		l.limit = limit
+		l.buckets = nil
+	}
+}
+
+// Takes n tokens from the bucket for key.
+// If there aren't enough, returns how long until there will be,
+// or zero if there never will, as n is larger than the burst.
+func (l *limiter) allow(key string, n int) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.limit.Rate <= 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+	l.sweep(now, time.Minute)
+
+	b := l.buckets[key]
+	if b == nil {
+		if len(l.buckets) >= maxBuckets {
+			l.sweep(now, time.Second)
+		}
+		if len(l.buckets) >= maxBuckets {
+			l.limited.Add(1)
+			return false, time.Second
+		}
+		if l.buckets == nil {
+			l.buckets = make(map[string]*bucket)
+		}
+		b = &bucket{tokens: float64(l.limit.Burst)}
+		l.buckets[key] = b
+	} else {
+		b.tokens = l.refill(b, now)
+	}
+	b.last = now
+
+	if n > l.limit.Burst {
+		// never allowed, however long the client waits
+		l.limited.Add(1)
+		return false, 0
+	}
+	if b.tokens < float64(n) {
+		l.limited.Add(1)
+		return false, time.Duration((float64(n) - b.tokens) / l.limit.Rate * float64(time.Second))
+	}
+	b.tokens -= float64(n)
+	return true, 0
+}
+
+func (l *limiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*l.limit.Rate
+	return math.Min(tokens, float64(l.limit.Burst))
+}
+
+// Forgets full buckets, at most once per interval.
+func (l *limiter) sweep(now time.Time, interval time.Duration) {
+	if now.Sub(l.swept) < interval {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *limiter) stats() any {
+	l.Lock()
+	defer l.Unlock()
+	return map[string]any{
+		"rate":    l.limit.Rate,
+		"burst":   l.limit.Burst,
+		"clients": len(l.buckets),
+		"limited": l.limited.Value(),
+	}
+}
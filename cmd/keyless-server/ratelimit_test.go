@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	var l limiter
+	if ok, _ := l.allow("a", 1); !ok {
+		t.Fatal("unconfigured limiter denied a request")
+	}
+
+	l.configure(rateLimit{Rate: 1, Burst: 2})
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("a", 1); !ok {
+			t.Fatalf("request %d denied within burst", i)
+		}
+	}
+
+	ok, retry := l.allow("a", 1)
+	if ok {
+		t.Fatal("request allowed over burst")
+	}
+	if retry <= 0 || retry > time.Second {
+		t.Errorf("got retry %v, wanted up to 1s", retry)
+	}
+
+	if ok, _ := l.allow("b", 1); !ok {
+		t.Error("request denied for another key")
+	}
+
+	// fake the passage of time
+	l.buckets["a"].last = l.buckets["a"].last.Add(-time.Second)
+	if ok, _ := l.allow("a", 1); !ok {
+		t.Error("request denied after refill")
+	}
+}
+
+func TestLimiter_batch(t *testing.T) {
+	var l limiter
+	l.configure(rateLimit{Rate: 1, Burst: 4})
+
+	ok, retry := l.allow("a", 5)
+	if ok || retry != 0 {
+		t.Errorf("got %v, %v for a batch over burst, wanted denied for good", ok, retry)
+	}
+	if ok, _ := l.allow("a", 4); !ok {
+		t.Fatal("batch denied within burst")
+	}
+	ok, retry = l.allow("a", 2)
+	if ok {
+		t.Fatal("batch allowed over the remaining tokens")
+	}
+	if retry <= time.Second || retry > 2*time.Second {
+		t.Errorf("got retry %v, wanted up to 2s", retry)
+	}
+	if tokens := l.buckets["a"].tokens; tokens < 0 {
+		t.Errorf("bucket in debt: %v", tokens)
+	}
+}
+
+func TestLimiter_full(t *testing.T) {
+	var l limiter
+	l.configure(rateLimit{Rate: 1, Burst: 1})
+	for i := range maxBuckets {
+		if ok, _ := l.allow(strconv.Itoa(i), 1); !ok {
+			t.Fatalf("request %d denied", i)
+		}
+	}
+	if ok, _ := l.allow("new", 1); ok {
+		t.Error("request allowed for a new key while full")
+	}
+}
+
+func TestIPKey(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"192.0.2.1:1234", "192.0.2.1"},
+		{"[::ffff:192.0.2.1]:1234", "192.0.2.1"},
+		{"[2001:db8:1:2:3:4:5:6]:1234", "2001:db8:1:2::/64"},
+		{"[2001:db8:1:2:ffff::1]:1234", "2001:db8:1:2::/64"},
+		{"[fe80::1%eth0]:1234", "fe80::/64"},
+		{"pipe", ""},
+	}
+	for _, tt := range tests {
+		if got := ipKey(tt.addr); got != tt.want {
+			t.Errorf("ipKey(%q) = %q, wanted %q", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"time"
@@ -20,44 +21,46 @@ func replicaClient(typ, id string) []string {
 		return nil
 	}
 
-	conn, err := net.Dial("udp", config.Replica)
+	res, err := replicaQuery(typ, id)
 	if err != nil {
+		replicaRequests.inc("failure")
 		log.Println(err)
 		return nil
 	}
-	conn.SetDeadline(time.Now().Add(time.Second))
+	replicaRequests.inc("success")
+	return res
+}
+
+func replicaQuery(typ, id string) (replicaResponse, error) {
+	conn, err := net.Dial("udp", config.Replica)
 	if err != nil {
-		log.Println(err)
-		return nil
+		return nil, err
 	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
 
 	var buf [512]byte
 	var req = replicaRequest{ChallengeType: typ, ChallengeID: id}
 	if json, err := json.Marshal(req); err != nil {
-		log.Println(err)
-		return nil
+		return nil, err
 	} else if len(json) > len(buf) {
-		log.Println("request size too long", len(json))
-		return nil
+		return nil, fmt.Errorf("request size too long %d", len(json))
 	} else {
 		for i := copy(buf[:], json); i < len(buf); i++ {
 			buf[i] = ' '
 		}
 	}
 	if _, err := conn.Write(buf[:]); err != nil {
-		log.Println(err)
-		return nil
+		return nil, err
 	}
 
 	var res replicaResponse
 	if n, err := conn.Read(buf[:]); err != nil {
-		log.Println(err)
-		return nil
+		return nil, err
 	} else if err := json.Unmarshal(buf[:n], &res); err != nil {
-		log.Println(err)
-		return nil
+		return nil, err
 	}
-	return res
+	return res, nil
 }
 
 func replicaServe(conn net.PacketConn) error {
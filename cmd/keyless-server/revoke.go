@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often the denylist and CRL files are checked for changes.
+const revocationPollInterval = 30 * time.Second
+
+// Revoked client certificates.
+type revocationList struct {
+	serials      map[string]bool // hex, from the denylist
+	fingerprints map[string]bool // SHA-256 hex, from the denylist
+	crl          map[string]bool // issuer and serial, from the CRL
+}
+
+var revocations struct {
+	atomic.Pointer[revocationList]
+
+	sync.Mutex
+	modified [2]time.Time
+}
+
+// Loads the denylist and CRL files, if they changed.
+func loadRevocations() error {
+	revocations.Lock()
+	defer revocations.Unlock()
+
+	var modified [2]time.Time
+	for i, name := range []string{config.API.ClientDenylist, config.API.ClientCRL} {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		modified[i] = fi.ModTime()
+	}
+	if modified == revocations.modified && revocations.Load() != nil {
+		return nil
+	}
+
+	var list revocationList
+	if config.API.ClientDenylist != "" {
+		if err := list.loadDenylist(config.API.ClientDenylist); err != nil {
+			return fmt.Errorf("api.client_denylist: %w", err)
+		}
+	}
+	if config.API.ClientCRL != "" {
+		if err := list.loadCRL(config.API.ClientCRL); err != nil {
+			return fmt.Errorf("api.client_crl: %w", err)
+		}
+	}
+
+	if revocations.Load() != nil {
+		log.Println("reloaded revoked client certificates")
+	}
+	revocations.Store(&list)
+	revocations.modified = modified
+	return nil
+}
+
+// Periodically reloads revoked certificates.
+func watchRevocations() {
+	if config.API.ClientDenylist == "" && config.API.ClientCRL == "" {
+		return
+	}
+	for {
+		time.Sleep(revocationPollInterval)
+		if err := loadRevocations(); err != nil {
+			log.Println("revocations:", err)
+		}
+	}
+}
+
+// Reads serial numbers and fingerprints, one per line.
+// Everything after a # is a comment.
+func (l *revocationList) loadDenylist(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	l.serials = make(map[string]bool)
+	l.fingerprints = make(map[string]bool)
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(line), ":", ""))
+		if line == "" {
+			continue
+		}
+		if strings.Trim(line, "0123456789abcdef") != "" {
+			return fmt.Errorf("line %d: invalid serial or fingerprint", n)
+		}
+		if len(line) == 2*sha256.Size {
+			l.fingerprints[line] = true
+		} else if serial := strings.TrimLeft(line, "0"); serial != "" {
+			l.serials[serial] = true
+		} else {
+			l.serials["0"] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// Reads a CRL (PEM or DER), which must be signed by a client CA.
+func (l *revocationList) loadCRL(name string) error {
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if block, _ := pem.Decode(buf); block != nil {
+		if block.Type != "X509 CRL" {
+			return fmt.Errorf("unexpected PEM block: %s", block.Type)
+		}
+		buf = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(buf)
+	if err != nil {
+		return err
+	}
+	if err := checkCRLSignature(crl); err != nil {
+		return err
+	}
+	if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+		log.Println("api.client_crl: CRL is past its next update")
+	}
+
+	l.crl = make(map[string]bool)
+	for _, entry := range crl.RevokedCertificateEntries {
+		l.crl[string(crl.RawIssuer)+entry.SerialNumber.String()] = true
+	}
+	return nil
+}
+
+func checkCRLSignature(crl *x509.RevocationList) error {
+	var cas []*x509.Certificate
+	if config.API.ClientCA != "" {
+		buf, err := os.ReadFile(config.API.ClientCA)
+		if err != nil {
+			return err
+		}
+		for {
+			var block *pem.Block
+			block, buf = pem.Decode(buf)
+			if block == nil {
+				break
+			}
+			if ca, err := x509.ParseCertificate(block.Bytes); err == nil {
+				cas = append(cas, ca)
+			}
+		}
+	}
+	if enrollCA != nil {
+		cas = append(cas, enrollCA.Leaf)
+	}
+
+	for _, ca := range cas {
+		if bytes.Equal(ca.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+			return nil
+		}
+	}
+	return errors.New("CRL is not signed by a client CA")
+}
+
+// Checks that none of the certificates in the chains is revoked.
+func checkRevoked(chains [][]*x509.Certificate) error {
+	list := revocations.Load()
+	if list == nil {
+		return nil
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if list.revoked(cert) {
+				return fmt.Errorf("revoked certificate: %s (serial %x)", cert.Subject, cert.SerialNumber)
+			}
+		}
+	}
+	return nil
+}
+
+func (l *revocationList) revoked(cert *x509.Certificate) bool {
+	if l.serials[cert.SerialNumber.Text(16)] {
+		return true
+	}
+	if l.crl[string(cert.RawIssuer)+cert.SerialNumber.String()] {
+		return true
+	}
+	// enrolled certificates are also revoked with their installation
+	if id := installationID(cert); id != "" {
+		if l.serials[id] {
+			return true
+		}
+		if serial, ok := new(big.Int).SetString(id, 16); ok && l.crl[string(cert.RawIssuer)+serial.String()] {
+			return true
+		}
+	}
+	if len(l.fingerprints) > 0 {
+		hash := sha256.Sum256(cert.Raw)
+		return l.fingerprints[hex.EncodeToString(hash[:])]
+	}
+	return false
+}
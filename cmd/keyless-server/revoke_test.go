@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRevocations(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(serial int64, template *x509.Certificate, parent *x509.Certificate) *x509.Certificate {
+		template.SerialNumber = big.NewInt(serial)
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(time.Hour)
+		if parent == nil {
+			parent = template
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	ca := issue(1, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "client CA"},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil)
+	clients := []*x509.Certificate{
+		issue(0x10, &x509.Certificate{Subject: pkix.Name{CommonName: "by serial"}}, ca),
+		issue(0x11, &x509.Certificate{Subject: pkix.Name{CommonName: "by fingerprint"}}, ca),
+		issue(0x12, &x509.Certificate{Subject: pkix.Name{CommonName: "by CRL"}}, ca),
+		issue(0x13, &x509.Certificate{Subject: pkix.Name{CommonName: "valid"}}, ca),
+	}
+
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: big.NewInt(0x12), RevocationTime: time.Now()}},
+	}, ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprint := sha256.Sum256(clients[1].Raw)
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		name = filepath.Join(dir, name)
+		if err := os.WriteFile(name, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+
+	saved := config.API
+	defer func() { config.API = saved; revocations.Store(nil) }()
+	config.API.ClientCA = write("ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))
+	config.API.ClientCRL = write("crl.pem", pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}))
+	config.API.ClientDenylist = write("denylist", []byte("# revoked\n00:10\n"+hex.EncodeToString(fingerprint[:])+" # leaked\n"))
+
+	if err := loadRevocations(); err != nil {
+		t.Fatal(err)
+	}
+	for i, cert := range clients {
+		err := checkRevoked([][]*x509.Certificate{{cert, ca}})
+		if (err == nil) != (i == 3) {
+			t.Errorf("%s: got %v", cert.Subject.CommonName, err)
+		}
+	}
+
+	// changes are picked up
+	write("denylist", []byte("13\n"))
+	os.Chtimes(config.API.ClientDenylist, time.Time{}, time.Now().Add(time.Minute))
+	if err := loadRevocations(); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRevoked([][]*x509.Certificate{{clients[3]}}); err == nil {
+		t.Error("denylist was not reloaded")
+	}
+	if err := checkRevoked([][]*x509.Certificate{{clients[0]}}); err != nil {
+		t.Error(err)
+	}
+
+	// bad files are rejected, and the previous list kept
+	write("denylist", []byte("not hex\n"))
+	os.Chtimes(config.API.ClientDenylist, time.Time{}, time.Now().Add(2*time.Minute))
+	if err := loadRevocations(); err == nil {
+		t.Error("accepted an invalid denylist")
+	}
+	if err := checkRevoked([][]*x509.Certificate{{clients[3]}}); err == nil {
+		t.Error("previous denylist was dropped")
+	}
+}
@@ -165,13 +165,12 @@ func setupAPI(ctx context.Context, client *acmez.Client, acct acme.Account) erro
 		return nil
 	}
 
-	var hostname string
 	app := filepath.Base(os.Args[0])
-	if i := strings.IndexByte(config.API.Handler, '/'); i > 0 {
-		hostname = config.API.Handler[:i]
-	} else {
+	hostnames := apiHostnames()
+	if len(hostnames) == 0 {
 		return errors.New("API handler does not have a hostname")
 	}
+	hostname := hostnames[0]
 
 	key, err := setupKey("API", config.API.Key)
 	if err != nil {
@@ -181,7 +180,9 @@ func setupAPI(ctx context.Context, client *acmez.Client, acct acme.Account) erro
 	fmt.Println()
 	fmt.Println("Starting HTTPS server for hostname validation...")
 	fmt.Println("Please, ensure that:")
-	fmt.Printf(" - %s is reachable from the internet on TCP %s:443\n", app, hostname)
+	for _, hostname := range hostnames {
+		fmt.Printf(" - %s is reachable from the internet on TCP %s:443\n", app, hostname)
+	}
 	fmt.Print("Continue? ")
 	fmt.Scanln()
 
@@ -201,8 +202,8 @@ func setupAPI(ctx context.Context, client *acmez.Client, acct acme.Account) erro
 
 	fmt.Println()
 	client.ChallengeSolvers = solvers.GetAPISolvers()
-	fmt.Printf("Obtaining a certificate for %s...\n", hostname)
-	return obtainCertificate(ctx, client, acct, key, config.API.Certificate, hostname)
+	fmt.Printf("Obtaining a certificate for %s...\n", strings.Join(hostnames, ", "))
+	return obtainCertificate(ctx, client, acct, key, config.API.Certificate, hostnames...)
 }
 
 func setupKey(keyName, keyFile string) (*ecdsa.PrivateKey, error) {
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+)
+
+var stats = expvar.NewMap("keyless")
+
+func init() {
+	stats.Set("rate_limit", expvar.Func(func() any {
+		return map[string]any{
+			"ip":     rateLimits.ip.stats(),
+			"client": rateLimits.client.stats(),
+		}
+	}))
+	stats.Set("signing", expvar.Func(func() any {
+		return signingPool.stats()
+	}))
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(stats.String()))
+}
@@ -0,0 +1,157 @@
+// Command keyless serves a directory, or proxies an app, over HTTPS
+// using a keyless certificate.
+//
+// Usage:
+//
+//	keyless [flags] serve <dir>
+//	keyless [flags] proxy <upstream-url>
+//
+// The API URL can also be set with the KEYLESS_API environment variable.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ncruces/keyless"
+)
+
+func main() {
+	apiURL := flag.String("api", os.Getenv("KEYLESS_API"), "keyless server API `url`")
+	certFile := flag.String("cert", "", "client certificate `file` for mTLS")
+	keyFile := flag.String("key", "", "client key `file` for mTLS")
+	tokenFile := flag.String("token", "", "bearer token `file`")
+	agent := flag.String("agent", "", "keyless-agent socket `path`")
+	addr := flag.String("addr", ":8443", "`address` to listen on")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "usage: %s [flags] serve <dir>\n", os.Args[0])
+		fmt.Fprintf(out, "       %s [flags] proxy <upstream-url>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 || *apiURL == "" && *agent == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var handler http.Handler
+	switch flag.Arg(0) {
+	case "serve":
+		handler = http.FileServer(http.Dir(flag.Arg(1)))
+	case "proxy":
+		upstream, err := url.Parse(flag.Arg(1))
+		if err != nil {
+			log.Fatalln("upstream:", err)
+		}
+		handler = &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(upstream)
+				r.SetXForwarded()
+			},
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	client := &keyless.Client{APIURL: *apiURL, Agent: *agent}
+	if *certFile != "" || *keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			log.Fatalln("mtls:", err)
+		}
+		client.Certificates = []tls.Certificate{cert}
+	}
+	if *tokenFile != "" {
+		buf, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			log.Fatalln("token:", err)
+		}
+		client.Token = strings.TrimSpace(string(buf))
+	}
+
+	cert, err := client.Certificate()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatalln("listen:", err)
+	}
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	for _, u := range localURLs(cert.Leaf.DNSNames, port) {
+		fmt.Println(u)
+	}
+
+	server := http.Server{
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			GetCertificate: client.GetCertificate,
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       10 * time.Minute,
+	}
+	log.Fatalln(server.ServeTLS(ln, "", ""))
+}
+
+// Returns the keyless URLs for each local address,
+// given the names in the keyless certificate.
+func localURLs(names []string, port string) []string {
+	var domain string
+	for _, name := range names {
+		if d, ok := strings.CutPrefix(name, "*."); ok {
+			domain = d
+			break
+		}
+	}
+	if domain == "" {
+		return nil
+	}
+
+	if port == "443" {
+		port = ""
+	} else {
+		port = ":" + port
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Println(err)
+	}
+
+	urls := []string{"https://local." + domain + port + "/"}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		var name string
+		ip := ipnet.IP
+		switch {
+		case ip.IsLoopback():
+			continue // local
+		case ip.To4() != nil:
+			name = strings.ReplaceAll(ip.To4().String(), ".", "-")
+		case ip.IsLinkLocalUnicast():
+			continue // needs a zone
+		default:
+			name = strings.ReplaceAll(ip.String(), ":", "-")
+		}
+		urls = append(urls, "https://"+name+"."+domain+port+"/")
+	}
+	return urls
+}
@@ -0,0 +1,161 @@
+package keyless
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How long to wait before retrying a failed enrollment.
+const enrollRetryInterval = time.Minute
+
+// Returns the client certificate to authenticate with:
+// the enrolled certificate, while valid, or the first of Certificates.
+func (c *Client) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if cert := c.enrolled.Load(); cert != nil && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+	if len(c.Certificates) > 0 {
+		return &c.Certificates[0], nil
+	}
+	return &tls.Certificate{}, nil
+}
+
+// Enrolls the client, if it has no valid certificate, waiting for it,
+// or renews its certificate in the background, if it's due.
+func (c *Client) checkEnrollment() error {
+	if c.EnrollmentFile == "" || c.Agent != "" {
+		return nil
+	}
+	cert := c.enrolled.Load()
+	if cert == nil || time.Now().After(cert.Leaf.NotAfter) {
+		if err := c.renewEnrollment(); err != nil {
+			return fmt.Errorf("enrolling: %w", err)
+		}
+		return nil
+	}
+	if time.Now().After(renewalTime(cert.Leaf)) && c.renewing.CompareAndSwap(false, true) {
+		go func() {
+			defer c.renewing.Store(false)
+			c.renewEnrollment()
+		}()
+	}
+	return nil
+}
+
+// Certificates are renewed when two thirds of their validity have passed.
+func renewalTime(leaf *x509.Certificate) time.Time {
+	return leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) * 2 / 3)
+}
+
+func (c *Client) renewEnrollment() error {
+	c.enroll.Lock()
+	defer c.enroll.Unlock()
+
+	if cert := c.enrolled.Load(); cert != nil && time.Now().Before(renewalTime(cert.Leaf)) {
+		return nil
+	}
+	if time.Since(c.enroll.tried) < enrollRetryInterval {
+		return c.enroll.err
+	}
+	c.enroll.tried = time.Now()
+	c.enroll.err = c.enrollCertificate()
+	return c.enroll.err
+}
+
+// Requests a client certificate for a new key,
+// authenticating with the current certificate, Certificates or Token,
+// and saves both to EnrollmentFile.
+func (c *Client) enrollCertificate() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		return err
+	}
+
+	req, err := c.newRequest("POST", "/v2/enroll",
+		bytes.NewReader(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/pkcs10")
+	req.Header.Set("Accept", "application/pem-certificate-chain")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return responseError(res)
+	}
+
+	chain, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	data := append(chain, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})...)
+
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return err
+	}
+	if len(cert.Certificate) == 0 || cert.Leaf == nil {
+		return errors.New("no certificates returned")
+	}
+	if err := writeFile(c.EnrollmentFile, data); err != nil {
+		return err
+	}
+
+	c.enrolled.Store(&cert)
+	// new connections present the new certificate
+	c.client.CloseIdleConnections()
+	return nil
+}
+
+// Loads a previously enrolled certificate.
+func (c *Client) loadEnrollment() {
+	cert, err := tls.LoadX509KeyPair(c.EnrollmentFile, c.EnrollmentFile)
+	if err == nil && cert.Leaf != nil {
+		c.enrolled.Store(&cert)
+	}
+}
+
+// Replaces a private file atomically.
+func writeFile(name string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
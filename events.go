@@ -0,0 +1,121 @@
+package keyless
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How long an event stream may be silent before it is dropped.
+// Servers send keep-alives more often than this.
+const eventsTimeout = 90 * time.Second
+
+var errEventsUnsupported = errors.New("server does not support events")
+
+// Subscribes to server events until ctx is done,
+// reconnecting with exponential backoff.
+func (c *Client) subscribe(ctx context.Context) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := c.watchEvents(ctx)
+		if errors.Is(err, errEventsUnsupported) || ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > eventsTimeout {
+			backoff = time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, 5*time.Minute)
+	}
+}
+
+// Reads a stream of Server-Sent Events, until it ends.
+func (c *Client) watchEvents(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := c.newRequest("GET", "/v2/events", nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+
+	res, err := c.stream.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return errEventsUnsupported
+	}
+	if res.StatusCode != 200 {
+		return responseError(res)
+	}
+
+	// drop streams that go silent
+	watchdog := time.AfterFunc(eventsTimeout, cancel)
+	defer watchdog.Stop()
+
+	var event, data string
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		watchdog.Reset(eventsTimeout)
+
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event == "certificate" {
+				c.certificateEvent([]byte(data))
+			}
+			event, data = "", ""
+		case strings.HasPrefix(line, ":"):
+			// comment
+		default:
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "event":
+				event = value
+			case "data":
+				if data != "" {
+					data += "\n"
+				}
+				data += value
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// Expires the cached certificate, if the server has a different one.
+func (c *Client) certificateEvent(data []byte) {
+	var event struct {
+		Serial string `json:"serial"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil || event.Serial == "" {
+		return
+	}
+
+	c.cache.Lock()
+	defer c.cache.Unlock()
+	if c.cache.cert != nil && c.cache.cert.Leaf.SerialNumber.Text(16) != event.Serial {
+		c.cache.expires = time.Time{}
+		c.cache.stale = true
+	}
+}
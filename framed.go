@@ -0,0 +1,251 @@
+package keyless
+
+import (
+	"crypto"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// framedProtocol is the ALPN protocol of the framed signing protocol,
+// described in keyless-server.
+const framedProtocol = "keyless/1"
+
+const (
+	framedOpSign = 1
+	framedOpAuth = 2
+)
+
+const framedStatusOK = 0
+
+var (
+	errFramedUnsupported = errors.New("server does not support the framed protocol")
+	errFramedClosed      = errors.New("connection closed")
+)
+
+// A persistent connection, with requests multiplexed by ID.
+type framedConn struct {
+	conn net.Conn
+
+	mtx     sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan framedResponse
+	err     error
+}
+
+type framedResponse struct {
+	status byte
+	data   []byte
+}
+
+// Signs a digest over the framed protocol.
+// Returns errFramedUnsupported if the server doesn't support it,
+// or a connection can't be established.
+func (c *Client) framedSign(id string, hash crypto.Hash, digest []byte) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil || len(key) != 32 {
+		return nil, errFramedUnsupported
+	}
+	if err := c.checkEnrollment(); err != nil {
+		return nil, fmt.Errorf("signing digest: %w", err)
+	}
+
+	// signing is idempotent, so retry once on a new connection;
+	// without a connection, fall back to HTTP
+	var res framedResponse
+	for range 2 {
+		conn, cerr := c.framedConn()
+		if cerr != nil {
+			return nil, errFramedUnsupported
+		}
+		res, err = conn.roundTrip(framedOpSign, hash, key, digest)
+		if !errors.Is(err, errFramedClosed) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("signing digest: %w", err)
+	}
+
+	if res.status != framedStatusOK {
+		code, _, _ := strings.Cut(string(res.data), ":")
+		if code == "key_not_found" {
+			// the key may have been rotated
+			c.invalidate(id)
+		}
+		return nil, fmt.Errorf("signing digest: %s", res.data)
+	}
+	return res.data, nil
+}
+
+// Returns the open connection, or opens a new one.
+func (c *Client) framedConn() (*framedConn, error) {
+	c.framed.Lock()
+	defer c.framed.Unlock()
+
+	if c.framed.unsupported {
+		return nil, errFramedUnsupported
+	}
+	if conn := c.framed.conn; conn != nil && conn.alive() {
+		return conn, nil
+	}
+	if time.Since(c.framed.failed) < time.Second {
+		return nil, errors.New("connection failed recently")
+	}
+
+	conn, err := c.dialFramed()
+	if errors.Is(err, errFramedUnsupported) {
+		c.framed.unsupported = true
+	} else if err != nil {
+		c.framed.failed = time.Now()
+	}
+	c.framed.conn = conn
+	return conn, err
+}
+
+func (c *Client) dialFramed() (*framedConn, error) {
+	u, err := url.Parse(c.api)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, errFramedUnsupported
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "443")
+	}
+
+	var cfg *tls.Config
+	if c.tlsConfig != nil {
+		cfg = c.tlsConfig.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	// offer HTTP/1.1 too, so servers without the framed protocol
+	// complete the handshake, rather than fail it
+	cfg.NextProtos = []string{framedProtocol, "http/1.1"}
+
+	dialer := tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second},
+		Config:    cfg,
+	}
+	nc, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if nc.(*tls.Conn).ConnectionState().NegotiatedProtocol != framedProtocol {
+		nc.Close()
+		return nil, errFramedUnsupported
+	}
+
+	conn := &framedConn{conn: nc, pending: make(map[uint32]chan framedResponse)}
+	go conn.read()
+
+	if c.Token != "" {
+		res, err := conn.roundTrip(framedOpAuth, 0, nil, []byte(c.Token))
+		if err == nil && res.status != framedStatusOK {
+			err = errors.New(string(res.data))
+		}
+		if err != nil {
+			conn.close(err)
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (f *framedConn) alive() bool {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.err == nil
+}
+
+// Fails pending and future requests.
+func (f *framedConn) close(err error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.err == nil {
+		f.err = err
+		f.conn.Close()
+	}
+	for id, ch := range f.pending {
+		close(ch)
+		delete(f.pending, id)
+	}
+}
+
+func (f *framedConn) roundTrip(op byte, hash crypto.Hash, key, data []byte) (framedResponse, error) {
+	msg := make([]byte, 40, 40+len(data))
+	msg[4] = op
+	msg[5] = byte(hash)
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(data)))
+	copy(msg[8:], key)
+	msg = append(msg, data...)
+
+	ch := make(chan framedResponse, 1)
+	f.mtx.Lock()
+	if f.err != nil {
+		f.mtx.Unlock()
+		return framedResponse{}, errFramedClosed
+	}
+	f.nextID++
+	id := f.nextID
+	binary.BigEndian.PutUint32(msg, id)
+	f.pending[id] = ch
+	f.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := f.conn.Write(msg)
+	f.mtx.Unlock()
+	if err != nil {
+		f.close(err)
+		return framedResponse{}, errFramedClosed
+	}
+
+	timer := time.NewTimer(5 * time.Second)
+	defer timer.Stop()
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			return res, errFramedClosed
+		}
+		return res, nil
+	case <-timer.C:
+		f.mtx.Lock()
+		delete(f.pending, id)
+		f.mtx.Unlock()
+		return framedResponse{}, errors.New("timeout awaiting response")
+	}
+}
+
+// Reads responses, until the connection fails.
+func (f *framedConn) read() {
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(f.conn, header[:]); err != nil {
+			f.close(err)
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint16(header[6:]))
+		if _, err := io.ReadFull(f.conn, data); err != nil {
+			f.close(err)
+			return
+		}
+
+		id := binary.BigEndian.Uint32(header[0:])
+		f.mtx.Lock()
+		ch := f.pending[id]
+		delete(f.pending, id)
+		f.mtx.Unlock()
+		if ch != nil {
+			ch <- framedResponse{status: header[4], data: data}
+		}
+	}
+}
@@ -2,103 +2,414 @@ package keyless
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// GetCertificate returns a function that can be used as the tls.Config.GetCertificate function.
+// It is a shortcut for a Client with the given API URL and mTLS certificates.
 func GetCertificate(apiURL string, mTLS ...tls.Certificate) func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	apiURL = strings.TrimSuffix(apiURL, "/")
+	c := &Client{APIURL: apiURL, Certificates: mTLS}
+	return c.GetCertificate
+}
+
+// Client fetches certificates from a keyless server,
+// and delegates signing to it.
+// Certificates are cached as allowed by the server.
+//
+// A Client must not be modified after first use.
+type Client struct {
+	// APIURL is the base URL of the keyless server API.
+	APIURL string
+
+	// Certificates are used to authenticate the client with mTLS.
+	Certificates []tls.Certificate
+
+	// Token is sent as a bearer token to authenticate the client,
+	// as an alternative to mTLS.
+	Token string
+
+	// BatchDelay, if positive, allows concurrent signatures to be
+	// coalesced into batch requests when the client is under load.
+	// Signatures may be delayed by up to BatchDelay (a few milliseconds).
+	BatchDelay time.Duration
+
+	// Framed, if set, sends signatures over a single persistent connection,
+	// with a compact binary protocol, rather than as HTTP requests.
+	// Servers that don't support it are used over HTTP.
+	Framed bool
+
+	// RootCAs are used to verify the API server certificate.
+	// If nil, the host's root CA set is used.
+	RootCAs *x509.CertPool
+
+	// Subscribe, if set, keeps a connection open to the server,
+	// which notifies the client as soon as the certificate is renewed,
+	// so the cached certificate is replaced immediately.
+	// Call Close to end the subscription.
+	Subscribe bool
+
+	// EnrollmentFile, if set, is where the client keeps a certificate
+	// issued by the server's enrollment CA, along with its private key.
+	// The client enrolls when the file is missing or expired,
+	// authenticating with Certificates or Token,
+	// and renews the certificate before it expires.
+	// The enrolled certificate is then used instead of Certificates.
+	EnrollmentFile string
+
+	// Agent is the path to the Unix socket of a keyless-agent.
+	// If set, all requests go through the agent,
+	// which holds the API connection and client certificate;
+	// APIURL, Certificates, Token, RootCAs and EnrollmentFile are ignored.
+	Agent string
+
+	once      sync.Once
+	api       string
+	prefix    string
+	client    *http.Client
+	stream    *http.Client
+	tlsConfig *tls.Config
+	stop      context.CancelFunc
+	legacy    atomic.Int64 // when v2 was last not found, Unix nanoseconds
+
+	enrolled atomic.Pointer[tls.Certificate]
+	renewing atomic.Bool
+	enroll   struct {
+		sync.Mutex
+		tried time.Time
+		err   error
+	}
+
+	batch batcher
+
+	framed struct {
+		sync.Mutex
+		conn        *framedConn
+		unsupported bool
+		failed      time.Time
+	}
 
-	var client *http.Client
-	if len(mTLS) == 0 {
-		client = http.DefaultClient
-	} else {
-		client = &http.Client{
+	cache struct {
+		sync.Mutex
+		cert    *tls.Certificate
+		etag    string
+		expires time.Time
+		checked time.Time
+		stale   bool
+	}
+}
+
+// agentURL is the base URL used to talk to a keyless-agent.
+const agentURL = "http://keyless-agent"
+
+func (c *Client) init() {
+	switch {
+	case c.Agent != "":
+		socket := c.Agent
+		c.api = agentURL
+		c.client = &http.Client{
 			Transport: &http.Transport{
-				Proxy:           http.ProxyFromEnvironment,
-				IdleConnTimeout: 10 * time.Minute,
-				TLSClientConfig: &tls.Config{
-					Certificates: mTLS,
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
 				},
+				IdleConnTimeout: 10 * time.Minute,
 			},
 			Timeout: 5 * time.Second,
 		}
-	}
 
-	return func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
-		// require SNI
-		if info.ServerName == "" {
-			return nil, errors.New("fetching certificate: missing server name")
+	case len(c.Certificates) == 0 && c.RootCAs == nil && c.EnrollmentFile == "":
+		c.api = strings.TrimSuffix(c.APIURL, "/")
+		c.client = http.DefaultClient
+
+	default:
+		tlsConfig := &tls.Config{
+			Certificates: c.Certificates,
+			RootCAs:      c.RootCAs,
+		}
+		if c.EnrollmentFile != "" {
+			tlsConfig.Certificates = nil
+			tlsConfig.GetClientCertificate = c.clientCertificate
+			c.loadEnrollment()
 		}
+		c.tlsConfig = tlsConfig
 
-		// fetch certificate
-		res, err := client.Get(apiURL + "/certificate?" + url.QueryEscape(info.ServerName))
-		if err != nil {
-			return nil, fmt.Errorf("fetching certificate: %w", err)
+		c.api = strings.TrimSuffix(c.APIURL, "/")
+		c.client = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				IdleConnTimeout: 10 * time.Minute,
+				TLSClientConfig: tlsConfig,
+			},
+			Timeout: 5 * time.Second,
 		}
-		defer res.Body.Close()
+	}
+
+	if u, err := url.Parse(c.api); err == nil {
+		c.prefix = u.Path
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stop = cancel
+	if c.Subscribe {
+		// event streams are long lived, so no timeout
+		c.stream = &http.Client{Transport: c.client.Transport}
+		go c.subscribe(ctx)
+	}
+}
+
+// Close ends the subscription to server events, if any,
+// and closes the framed connection, if open.
+func (c *Client) Close() error {
+	c.once.Do(c.init)
+	c.stop()
+
+	c.framed.Lock()
+	defer c.framed.Unlock()
+	if c.framed.conn != nil {
+		c.framed.conn.close(net.ErrClosed)
+	}
+	return nil
+}
+
+// GetCertificate can be used as the tls.Config.GetCertificate function.
+func (c *Client) GetCertificate(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.once.Do(c.init)
+
+	// require SNI
+	if info.ServerName == "" {
+		return nil, errors.New("fetching certificate: missing server name")
+	}
+
+	cert, err := c.fetchCertificate(info.ServerName)
+	if err != nil {
+		return nil, err
+	}
 
-		if res.StatusCode != 200 {
-			return nil, fmt.Errorf("fetching certificate: %s", res.Status)
+	if err := info.SupportsCertificate(cert); err != nil {
+		return nil, fmt.Errorf("fetching certificate: %w", err)
+	}
+
+	return cert, nil
+}
+
+// Certificate fetches the certificate served by the keyless server,
+// regardless of server name.
+// It can be used to learn which domain the certificate is valid for.
+func (c *Client) Certificate() (*tls.Certificate, error) {
+	c.once.Do(c.init)
+	return c.fetchCertificate("")
+}
+
+func (c *Client) fetchCertificate(serverName string) (*tls.Certificate, error) {
+	c.cache.Lock()
+	defer c.cache.Unlock()
+
+	if c.cache.cert != nil && time.Now().Before(c.cache.expires) {
+		if time.Since(c.cache.checked) > keyCheckInterval {
+			c.cache.checked = time.Now()
+			go c.checkKey(c.cache.cert.PrivateKey.(signer).id)
 		}
+		return c.cache.cert, nil
+	}
 
-		data, err := io.ReadAll(res.Body)
-		if err != nil {
-			return nil, fmt.Errorf("fetching certificate: %w", err)
+	// fetch certificate
+	var query string
+	if serverName != "" {
+		query = "?" + url.QueryEscape(serverName)
+	}
+	req, err := c.newRequest("GET", "/certificate"+query, nil)
+	if err != nil {
+		return nil, fmt.Errorf("fetching certificate: %w", err)
+	}
+	req.Header.Set("Accept", "application/pem-certificate-chain")
+	if c.cache.cert != nil && c.cache.etag != "" {
+		req.Header.Set("If-None-Match", c.cache.etag)
+	}
+	if c.cache.stale {
+		// skip intermediate caches, like the agent
+		req.Header.Set("Cache-Control", "no-cache")
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching certificate: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified && c.cache.cert != nil {
+		c.cache.expires = cacheExpiry(res.Header, c.cache.cert.Leaf)
+		c.cache.stale = false
+		return c.cache.cert, nil
+	}
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("fetching certificate: %w", responseError(res))
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fetching certificate: %w", err)
+	}
+
+	// decode certificate
+	var cert tls.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
 		}
+	}
 
-		// decode certificate
-		var cert tls.Certificate
-		for {
-			var block *pem.Block
-			block, data = pem.Decode(data)
-			if block == nil {
-				break
-			}
-			if block.Type == "CERTIFICATE" {
-				cert.Certificate = append(cert.Certificate, block.Bytes)
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("fetching certificate: no certificates returned")
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("fetching certificate: %w", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(cert.Leaf.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("fetching certificate: %w", err)
+	}
+
+	hash := sha256.Sum256(der)
+	cert.PrivateKey = signer{
+		pub:    cert.Leaf.PublicKey,
+		id:     base64.RawURLEncoding.EncodeToString(hash[:]),
+		client: c,
+	}
+
+	c.cache.cert = &cert
+	c.cache.etag = res.Header.Get("ETag")
+	c.cache.expires = cacheExpiry(res.Header, cert.Leaf)
+	c.cache.checked = time.Now()
+	c.cache.stale = false
+	return &cert, nil
+}
+
+// Returns how long a certificate can be cached,
+// given the Cache-Control header of the response.
+func cacheExpiry(header http.Header, leaf *x509.Certificate) time.Time {
+	var maxAge time.Duration
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-cache" || directive == "no-store" {
+			return time.Time{}
+		}
+		if v, ok := strings.CutPrefix(directive, "max-age="); ok {
+			secs, err := strconv.Atoi(v)
+			if err != nil {
+				return time.Time{}
 			}
+			maxAge = time.Duration(secs) * time.Second
 		}
+	}
 
-		if len(cert.Certificate) == 0 {
-			return nil, errors.New("fetching certificate: no certificates returned")
-		}
+	expires := time.Now().Add(maxAge)
+	if leaf.NotAfter.Before(expires) {
+		return leaf.NotAfter
+	}
+	return expires
+}
 
-		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
-		if err != nil {
-			return nil, fmt.Errorf("fetching certificate: %w", err)
-		}
+func (c *Client) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.api+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if c.Token != "" && c.Agent == "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return req, nil
+}
+
+// How long to use the legacy API before trying v2 again.
+const legacyRetryInterval = 10 * time.Minute
+
+// Sends a request to the v2 API, falling back to the legacy API
+// if the server doesn't support it, which is then remembered for a while.
+// The request must be for a legacy endpoint.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if err := c.checkEnrollment(); err != nil {
+		return nil, err
+	}
+	if t := c.legacy.Load(); t != 0 && time.Since(time.Unix(0, t)) < legacyRetryInterval {
+		return c.client.Do(req)
+	}
 
-		der, err := x509.MarshalPKIXPublicKey(cert.Leaf.PublicKey)
+	v2 := req.Clone(req.Context())
+	v2.URL.Path = c.prefix + "/v2" + strings.TrimPrefix(req.URL.Path, c.prefix)
+	v2.URL.RawPath = ""
+	if req.GetBody != nil {
+		body, err := req.GetBody()
 		if err != nil {
-			return nil, fmt.Errorf("fetching certificate: %w", err)
+			return nil, err
 		}
+		v2.Body = body
+	}
 
-		hash := sha256.Sum256(der)
-		cert.PrivateKey = signer{
-			pub:    cert.Leaf.PublicKey,
-			id:     base64.RawURLEncoding.EncodeToString(hash[:]),
-			api:    apiURL,
-			client: client,
-		}
+	res, err := c.client.Do(v2)
+	if err != nil || res.StatusCode != http.StatusNotFound || isJSON(res.Header) {
+		return res, err
+	}
 
-		if err := info.SupportsCertificate(&cert); err != nil {
-			return nil, fmt.Errorf("fetching certificate: %w", err)
-		}
+	// v2 errors are JSON; anything else means the endpoint doesn't exist,
+	// or a proxy failed, so try v2 again later
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	c.legacy.Store(time.Now().UnixNano())
+	return c.client.Do(req)
+}
 
-		return &cert, nil
+// Describes an error response,
+// including the message and request ID of v2 errors.
+func responseError(res *http.Response) error {
+	var body struct {
+		Error struct {
+			Code      string `json:"code"`
+			Message   string `json:"message"`
+			RequestID string `json:"request_id"`
+		} `json:"error"`
+	}
+	if isJSON(res.Header) {
+		err := json.NewDecoder(io.LimitReader(res.Body, 4096)).Decode(&body)
+		if err == nil && body.Error.Message != "" {
+			return fmt.Errorf("%s: %s (request %s)", res.Status, body.Error.Message, body.Error.RequestID)
+		}
 	}
+	return errors.New(res.Status)
+}
+
+func isJSON(header http.Header) bool {
+	ct, _, _ := strings.Cut(header.Get("Content-Type"), ";")
+	return strings.EqualFold(strings.TrimSpace(ct), "application/json")
 }
 
 var _ crypto.Signer = signer{}
@@ -106,8 +417,7 @@ var _ crypto.Signer = signer{}
 type signer struct {
 	pub    crypto.PublicKey
 	id     string
-	api    string
-	client *http.Client
+	client *Client
 }
 
 func (s signer) Public() crypto.PublicKey {
@@ -115,18 +425,39 @@ func (s signer) Public() crypto.PublicKey {
 }
 
 func (s signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) (signature []byte, err error) {
+	if s.client.Framed && s.client.Agent == "" {
+		signature, err := s.client.framedSign(s.id, opts.HashFunc(), digest)
+		if err != errFramedUnsupported {
+			return signature, err
+		}
+	}
 	hash := opts.HashFunc().String()
+	if s.client.BatchDelay > 0 {
+		return s.client.batchSign(s.id, hash, digest)
+	}
+	return s.client.sign(s.id, hash, digest)
+}
 
-	res, err := s.client.Post(
-		s.api+"/sign?key="+url.QueryEscape(s.id)+"&hash="+url.QueryEscape(hash),
-		"application/octet-stream", bytes.NewReader(digest))
+func (c *Client) sign(id, hash string, digest []byte) ([]byte, error) {
+	req, err := c.newRequest("POST",
+		"/sign?key="+url.QueryEscape(id)+"&hash="+url.QueryEscape(hash),
+		bytes.NewReader(digest))
+	if err != nil {
+		return nil, fmt.Errorf("signing digest: %w", err)
+	}
+
+	res, err := c.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("signing digest: %w", err)
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusNotFound {
+		// the key may have been rotated
+		c.invalidate(id)
+	}
 	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("signing digest: %s", res.Status)
+		return nil, fmt.Errorf("signing digest: %w", responseError(res))
 	}
 
 	data, err := io.ReadAll(res.Body)
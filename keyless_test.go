@@ -1,12 +1,23 @@
 package keyless_test
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
 
 	"github.com/ncruces/keyless"
+	"github.com/ncruces/keyless/keylesstest"
 )
 
 func ExampleGetCertificate() {
@@ -29,3 +40,415 @@ func ExampleGetCertificate() {
 
 	// Output:
 }
+
+func ExampleRouter() {
+	var router keyless.Router
+	router.HandleKeyless("ip.example.com", "https://keyless.example.com/")
+	router.HandleKeyless("ip.example.net", "https://keyless.example.net/")
+
+	custom, err := tls.LoadX509KeyPair("custom.pem", "custom.key")
+	if err == nil {
+		router.HandleCertificate("app.example.org", &custom)
+	}
+
+	srv := http.Server{
+		Addr: ":8443",
+		TLSConfig: &tls.Config{
+			GetCertificate: router.GetCertificate,
+		},
+	}
+
+	err = srv.ListenAndServeTLS("", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	certs := make([]tls.Certificate, 4)
+	var router keyless.Router
+	router.HandleCertificate("example.com", &certs[0])
+	router.HandleCertificate("*.ip.example.com", &certs[1])
+	router.HandleCertificate("Example.NET.", &certs[2])
+
+	tests := []struct {
+		name string
+		want *tls.Certificate
+	}{
+		{"example.com", &certs[0]},
+		{"www.example.com", &certs[0]},
+		{"ip.example.com", &certs[1]},
+		{"192-168-1-1.ip.example.com", &certs[1]},
+		{"LOCAL.IP.EXAMPLE.COM.", &certs[1]},
+		{"example.net", &certs[2]},
+		{"myexample.net", nil},
+		{"example.org", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := router.GetCertificate(&tls.ClientHelloInfo{ServerName: tt.name})
+			if got != tt.want {
+				t.Errorf("got %p, wanted %p", got, tt.want)
+			}
+			if (err != nil) != (tt.want == nil) {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+
+	router.Default = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return &certs[3], nil
+	}
+	got, err := router.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.org"})
+	if got != &certs[3] || err != nil {
+		t.Errorf("got %p, %v, wanted default", got, err)
+	}
+}
+
+func TestGetCertificate(t *testing.T) {
+	for _, mTLS := range []bool{false, true} {
+		t.Run(fmt.Sprint("mTLS=", mTLS), func(t *testing.T) {
+			srv := keylesstest.NewUnstartedServer()
+			srv.RequireClientCert = mTLS
+			srv.Start()
+			defer srv.Close()
+
+			client := srv.Client()
+			err := handshake(srv.ClientConfig("192-168-1-1."+srv.Domain), client.GetCertificate)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestGetCertificate_failures(t *testing.T) {
+	srv := keylesstest.NewServer()
+	defer srv.Close()
+
+	client := srv.Client()
+	config := srv.ClientConfig("local." + srv.Domain)
+
+	srv.Fail("/sign", http.StatusInternalServerError)
+	if err := handshake(config, client.GetCertificate); err == nil {
+		t.Error("handshake succeeded with failing signer")
+	}
+
+	srv.Fail("/sign", 0)
+	srv.Fail("/certificate", http.StatusServiceUnavailable)
+	if err := handshake(config, client.GetCertificate); err == nil {
+		t.Error("handshake succeeded without certificate")
+	}
+
+	srv.Fail("/certificate", 0)
+	if err := handshake(config, client.GetCertificate); err != nil {
+		t.Error(err)
+	}
+
+	other := srv.ClientConfig("local.example.com")
+	if err := handshake(other, client.GetCertificate); err == nil {
+		t.Error("handshake succeeded for the wrong domain")
+	}
+}
+
+func TestGetCertificate_mTLS(t *testing.T) {
+	srv := keylesstest.NewUnstartedServer()
+	srv.RequireClientCert = true
+	srv.Start()
+	defer srv.Close()
+
+	client := &keyless.Client{APIURL: srv.URL, RootCAs: srv.RootCAs()}
+	err := handshake(srv.ClientConfig("local."+srv.Domain), client.GetCertificate)
+	if err == nil {
+		t.Error("handshake succeeded without a client certificate")
+	}
+}
+
+func TestClient_legacy(t *testing.T) {
+	srv := keylesstest.NewUnstartedServer()
+	srv.Legacy = true
+	srv.Start()
+	defer srv.Close()
+
+	client := srv.Client()
+	config := srv.ClientConfig("local." + srv.Domain)
+
+	for i := 0; i < 2; i++ {
+		if err := handshake(config, client.GetCertificate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := srv.Requests("/v2/certificate"); n != 1 {
+		t.Errorf("got %d v2 certificate requests, wanted 1", n)
+	}
+	if n := srv.Requests("/v2/sign"); n != 0 {
+		t.Errorf("got %d v2 signing requests, wanted 0", n)
+	}
+	if n := srv.Requests("/sign"); n != 2 {
+		t.Errorf("got %d signing requests, wanted 2", n)
+	}
+}
+
+func TestClient_framed(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		t.Run(fmt.Sprint("legacy=", legacy), func(t *testing.T) {
+			srv := keylesstest.NewUnstartedServer()
+			srv.RequireClientCert = true
+			srv.Legacy = legacy
+			srv.Start()
+			defer srv.Close()
+
+			client := srv.Client()
+			client.Framed = true
+			defer client.Close()
+			config := srv.ClientConfig("local." + srv.Domain)
+
+			for i := 0; i < 2; i++ {
+				if err := handshake(config, client.GetCertificate); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// servers without the framed protocol are used over HTTP
+			framed, http := 2, 0
+			if legacy {
+				framed, http = 0, 2
+			}
+			if n := srv.Requests("keyless/1"); n != framed {
+				t.Errorf("got %d framed signatures, wanted %d", n, framed)
+			}
+			if n := srv.Requests("/sign"); n != http {
+				t.Errorf("got %d signing requests, wanted %d", n, http)
+			}
+		})
+	}
+}
+
+func TestClient_framedLegacy(t *testing.T) {
+	srv := keylesstest.NewUnstartedServer()
+	srv.Legacy = true
+	srv.Start()
+	defer srv.Close()
+
+	client := srv.Client()
+	client.Framed = true
+	defer client.Close()
+	config := srv.ClientConfig("local." + srv.Domain)
+
+	for i := 0; i < 2; i++ {
+		if err := handshake(config, client.GetCertificate); err != nil {
+			t.Fatal(err)
+		}
+		// past the delay before redialing after a failure
+		time.Sleep(1100 * time.Millisecond)
+	}
+
+	// one connection for HTTP, and one to find the framed protocol unsupported
+	if n := srv.Conns(); n != 2 {
+		t.Errorf("got %d connections, wanted 2", n)
+	}
+	if n := srv.Requests("/sign"); n != 2 {
+		t.Errorf("got %d signing requests, wanted 2", n)
+	}
+}
+
+// Completes a TLS handshake between a client with config,
+// and a server using getCertificate.
+func handshake(config *tls.Config, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) error {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	server := tls.Server(s, &tls.Config{GetCertificate: getCertificate})
+	client := tls.Client(c, config)
+
+	errs := make(chan error, 1)
+	go func() {
+		err := server.Handshake()
+		if err != nil {
+			s.Close()
+		}
+		errs <- err
+	}()
+
+	err := client.Handshake()
+	if err != nil {
+		c.Close()
+	}
+	if serr := <-errs; err == nil {
+		err = serr
+	}
+	return err
+}
+
+func TestGetCertificate_cache(t *testing.T) {
+	srv := keylesstest.NewUnstartedServer()
+	srv.CacheMaxAge = time.Hour
+	srv.Start()
+	defer srv.Close()
+
+	client := srv.Client()
+	config := srv.ClientConfig("local." + srv.Domain)
+
+	for i := 0; i < 3; i++ {
+		if err := handshake(config, client.GetCertificate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := srv.Requests("/certificate"); n != 1 {
+		t.Errorf("got %d certificate requests, wanted 1", n)
+	}
+	if n := srv.Requests("/sign"); n != 3 {
+		t.Errorf("got %d signing requests, wanted 3", n)
+	}
+}
+
+func TestGetCertificate_rotate(t *testing.T) {
+	srv := keylesstest.NewUnstartedServer()
+	srv.CacheMaxAge = time.Hour
+	srv.Start()
+	defer srv.Close()
+
+	client := srv.Client()
+	config := srv.ClientConfig("local." + srv.Domain)
+
+	if err := handshake(config, client.GetCertificate); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := client.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Status != "active" {
+		t.Fatalf("got %v, wanted a single active key", keys)
+	}
+
+	// the cached certificate fails, and is dropped
+	srv.Rotate()
+	if err := handshake(config, client.GetCertificate); err == nil {
+		t.Error("handshake succeeded with a rotated key")
+	}
+	if err := handshake(config, client.GetCertificate); err != nil {
+		t.Error(err)
+	}
+	if n := srv.Requests("/certificate"); n != 2 {
+		t.Errorf("got %d certificate requests, wanted 2", n)
+	}
+}
+
+func TestClient_subscribe(t *testing.T) {
+	srv := keylesstest.NewUnstartedServer()
+	srv.CacheMaxAge = time.Hour
+	srv.Start()
+	defer srv.Close()
+
+	client := srv.Client()
+	client.Subscribe = true
+	defer client.Close()
+
+	old, err := client.Certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the cached certificate is replaced without failing a handshake
+	srv.Rotate()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		cert, err := client.Certificate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert != old {
+			break
+		}
+	}
+	if err := handshake(srv.ClientConfig("local."+srv.Domain), client.GetCertificate); err != nil {
+		t.Error(err)
+	}
+	if n := srv.Requests("/certificate"); n != 2 {
+		t.Errorf("got %d certificate requests, wanted 2", n)
+	}
+}
+
+func TestClient_enroll(t *testing.T) {
+	srv := keylesstest.NewUnstartedServer()
+	srv.RequireClientCert = true
+	srv.EnrollValidity = 1500 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	file := filepath.Join(t.TempDir(), "client.pem")
+
+	// enroll with the shared certificate
+	client := srv.Client()
+	client.EnrollmentFile = file
+	if _, err := client.Certificate(); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Requests("/enroll"); n != 1 {
+		t.Errorf("got %d enroll requests, wanted 1", n)
+	}
+
+	// reuse the enrolled certificate
+	client = &keyless.Client{APIURL: srv.URL, RootCAs: srv.RootCAs(), EnrollmentFile: file}
+	if _, err := client.Certificate(); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Requests("/enroll"); n != 1 {
+		t.Errorf("got %d enroll requests, wanted 1", n)
+	}
+
+	// renew before it expires
+	time.Sleep(time.Second)
+	for start := time.Now(); srv.Requests("/enroll") < 2; time.Sleep(10 * time.Millisecond) {
+		if _, err := client.Certificate(); err != nil {
+			t.Fatal(err)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("certificate was not renewed")
+		}
+	}
+}
+
+func TestClient_batch(t *testing.T) {
+	srv := keylesstest.NewServer()
+	defer srv.Close()
+	srv.SetLatency(20 * time.Millisecond)
+
+	client := srv.Client()
+	client.BatchDelay = 5 * time.Millisecond
+
+	cert, err := client.Certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := cert.PrivateKey.(crypto.Signer)
+	pub := cert.Leaf.PublicKey.(*ecdsa.PublicKey)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			digest := sha256.Sum256([]byte{byte(i)})
+			sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+				t.Error("invalid signature")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := srv.Requests("/sign/batch"); n == 0 {
+		t.Error("no batch requests")
+	}
+	if n := srv.Requests("/sign") + srv.Requests("/sign/batch"); n >= 16 {
+		t.Errorf("got %d requests, wanted fewer than 16", n)
+	}
+}
@@ -0,0 +1,655 @@
+// Package keylesstest provides an in-process keyless server for testing.
+//
+// The server speaks the same /certificate and /sign protocol as keyless-server,
+// under both the legacy and v2 APIs, but is backed by an in-memory CA that issues a wildcard certificate for a test domain.
+package keylesstest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ncruces/keyless"
+)
+
+// Domain is the default test domain.
+const Domain = "ip.keyless.test"
+
+// Server is a fake keyless server.
+type Server struct {
+	// URL is the base URL of the API, set by Start.
+	URL string
+
+	// Domain is the domain for which a wildcard certificate is issued.
+	// It must not be modified after Start.
+	Domain string
+
+	// CacheMaxAge, if positive, allows clients to cache the certificate.
+	// It must not be modified after Start.
+	CacheMaxAge time.Duration
+
+	// RequireClientCert makes the server require client certificates
+	// issued by ClientCertificate.
+	// It must not be modified after Start.
+	RequireClientCert bool
+
+	// EnrollValidity is the validity of client certificates
+	// the server issues to enrolling clients; the default is a day.
+	// It must not be modified after Start.
+	EnrollValidity time.Duration
+
+	// Legacy makes the server serve only the unversioned API,
+	// like older keyless servers.
+	// It must not be modified after Start.
+	Legacy bool
+
+	server  *httptest.Server
+	caCert  *x509.Certificate
+	caKey   *ecdsa.PrivateKey
+	key     *ecdsa.PrivateKey
+	keyID   string
+	serial  string
+	chain   []byte
+	rootCAs *x509.CertPool
+
+	mtx      sync.Mutex
+	latency  time.Duration
+	failures map[string]int
+	requests map[string]int
+	conns    int
+	subs     map[chan struct{}]struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewServer starts and returns a new Server for Domain.
+// The caller should call Close when finished, to shut it down.
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a new Server for Domain, but doesn't start it.
+// After changing its configuration, the caller should call Start.
+func NewUnstartedServer() *Server {
+	s := &Server{Domain: Domain, closed: make(chan struct{})}
+
+	var err error
+	s.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic("keylesstest: " + err.Error())
+	}
+	s.caCert = s.issue(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "keylesstest CA"},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, s.caKey)
+
+	s.rootCAs = x509.NewCertPool()
+	s.rootCAs.AddCert(s.caCert)
+	return s
+}
+
+// Start starts a server from NewUnstartedServer.
+func (s *Server) Start() {
+	if s.server != nil {
+		panic("keylesstest: server already started")
+	}
+
+	s.Rotate()
+
+	api := s.keyPair(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "keylesstest API"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+
+	var mux http.ServeMux
+	for _, prefix := range []string{"", "/v2"} {
+		if prefix != "" && s.Legacy {
+			continue
+		}
+		mux.HandleFunc(prefix+"/certificate", s.certificateHandler)
+		mux.HandleFunc(prefix+"/sign", s.signingHandler)
+		mux.HandleFunc(prefix+"/sign/batch", s.batchSigningHandler)
+		mux.HandleFunc(prefix+"/keys", s.keysHandler)
+	}
+	if !s.Legacy {
+		mux.HandleFunc("/v2/events", s.eventsHandler)
+		mux.HandleFunc("/v2/enroll", s.enrollHandler)
+		mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+			writeError(w, r, http.StatusNotFound)
+		})
+	}
+
+	s.server = httptest.NewUnstartedServer(s.wrap(&mux))
+	s.server.EnableHTTP2 = true
+	s.server.TLS = &tls.Config{Certificates: []tls.Certificate{api}}
+	s.server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			s.mtx.Lock()
+			s.conns++
+			s.mtx.Unlock()
+		}
+	}
+	// like older servers, legacy ones don't offer the framed protocol
+	s.server.TLS.NextProtos = []string{"h2", "http/1.1"}
+	if !s.Legacy {
+		s.server.TLS.NextProtos = []string{framedProtocol, "h2", "http/1.1"}
+		s.server.Config.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+			framedProtocol: s.framedServe,
+		}
+		s.server.Config.Protocols = new(http.Protocols)
+		s.server.Config.Protocols.SetHTTP1(true)
+		s.server.Config.Protocols.SetHTTP2(true)
+	}
+	if s.RequireClientCert {
+		s.server.TLS.ClientCAs = s.rootCAs
+		s.server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	s.server.StartTLS()
+	s.URL = s.server.URL
+}
+
+// Rotate replaces the signing key, and issues a new certificate for it.
+// The previous key stops working immediately.
+func (s *Server) Rotate() {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic("keylesstest: " + err.Error())
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		panic("keylesstest: " + err.Error())
+	}
+	hash := sha256.Sum256(der)
+
+	leaf := s.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "*." + s.Domain},
+		DNSNames:    []string{"*." + s.Domain, s.Domain},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, key)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.key = key
+	s.keyID = base64.RawURLEncoding.EncodeToString(hash[:])
+	s.serial = leaf.SerialNumber.Text(16)
+	s.chain = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})
+
+	// notify subscribed clients
+	for ch := range s.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close shuts down the server.
+// It is safe to call Close more than once.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		if s.server != nil {
+			s.server.Close()
+		}
+	})
+}
+
+// RootCAs returns a pool that trusts both the API
+// and the certificates served by the API.
+func (s *Server) RootCAs() *x509.CertPool {
+	return s.rootCAs
+}
+
+// ClientCertificate issues a client certificate accepted by the server.
+func (s *Server) ClientCertificate() tls.Certificate {
+	return s.keyPair(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "keylesstest client"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+// Client returns a keyless.Client configured to use the server.
+// If the server requires client certificates, the client has one.
+func (s *Server) Client() *keyless.Client {
+	c := &keyless.Client{
+		APIURL:  s.URL,
+		RootCAs: s.rootCAs,
+	}
+	if s.RequireClientCert {
+		c.Certificates = []tls.Certificate{s.ClientCertificate()}
+	}
+	return c
+}
+
+// ClientConfig returns a tls.Config for a client that connects to name,
+// and trusts the certificates served by the API.
+func (s *Server) ClientConfig(name string) *tls.Config {
+	return &tls.Config{
+		ServerName: name,
+		RootCAs:    s.rootCAs,
+	}
+}
+
+// SetLatency delays every request by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.latency = d
+}
+
+// Fail makes every request to path fail with status.
+// A zero status clears the failure.
+func (s *Server) Fail(path string, status int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.failures == nil {
+		s.failures = make(map[string]int)
+	}
+	if status == 0 {
+		delete(s.failures, path)
+	} else {
+		s.failures[path] = status
+	}
+}
+
+// Requests returns the number of requests made to path.
+// Requests to the v2 API are counted under the unversioned path,
+// and signatures over the framed protocol under "keyless/1".
+func (s *Server) Requests(path string) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.requests[path]
+}
+
+// Conns returns the number of connections accepted,
+// including those that fail the TLS handshake.
+func (s *Server) Conns() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.conns
+}
+
+func (s *Server) wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mtx.Lock()
+		if s.requests == nil {
+			s.requests = make(map[string]int)
+		}
+		path := r.URL.Path
+		if !s.Legacy {
+			path = strings.TrimPrefix(path, "/v2")
+		}
+		s.requests[path]++
+		latency := s.latency
+		status := s.failures[path]
+		s.mtx.Unlock()
+
+		if latency > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(latency):
+			}
+		}
+		if status != 0 {
+			writeError(w, r, status)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) current() (key *ecdsa.PrivateKey, keyID string, chain []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.key, s.keyID, s.chain
+}
+
+func (s *Server) certificateHandler(w http.ResponseWriter, r *http.Request) {
+	_, keyID, chain := s.current()
+
+	etag := `"` + keyID + `"`
+	w.Header().Set("ETag", etag)
+	if s.CacheMaxAge > 0 {
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(s.CacheMaxAge.Seconds())))
+	}
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(chain)
+}
+
+func (s *Server) keysHandler(w http.ResponseWriter, r *http.Request) {
+	key, keyID, _ := s.current()
+
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	type keyInfo struct {
+		ID        string `json:"id"`
+		PublicKey []byte `json:"public_key"`
+		Status    string `json:"status"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Keys []keyInfo `json:"keys"`
+	}{[]keyInfo{{keyID, der, "active"}}})
+}
+
+func (s *Server) signingHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var digest [65]byte
+	n, err := io.ReadFull(r.Body, digest[:])
+	if err != io.ErrUnexpectedEOF {
+		writeError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	signature, status := s.sign(query.Get("key"), query.Get("hash"), digest[:n])
+	if status != http.StatusOK {
+		writeError(w, r, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(signature)
+}
+
+func (s *Server) batchSigningHandler(w http.ResponseWriter, r *http.Request) {
+	var items []struct {
+		Key    string `json:"key"`
+		Hash   string `json:"hash"`
+		Digest []byte `json:"digest"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		writeError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	type result struct {
+		Signature []byte `json:"signature,omitempty"`
+		Status    int    `json:"status"`
+		Error     string `json:"error,omitempty"`
+	}
+	results := make([]result, len(items))
+	for i, item := range items {
+		results[i].Signature, results[i].Status = s.sign(item.Key, item.Hash, item.Digest)
+		if results[i].Status != http.StatusOK {
+			results[i].Error = http.StatusText(results[i].Status)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	ch := make(chan struct{}, 1)
+	s.mtx.Lock()
+	if s.subs == nil {
+		s.subs = make(map[chan struct{}]struct{})
+	}
+	s.subs[ch] = struct{}{}
+	s.mtx.Unlock()
+
+	defer func() {
+		s.mtx.Lock()
+		delete(s.subs, ch)
+		s.mtx.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	for {
+		s.mtx.Lock()
+		serial, keyID := s.serial, s.keyID
+		s.mtx.Unlock()
+
+		data, _ := json.Marshal(map[string]string{"serial": serial, "key_id": keyID})
+		if _, err := fmt.Fprintf(w, "event: certificate\ndata: %s\n\n", data); err != nil {
+			return
+		}
+		http.NewResponseController(w).Flush()
+
+		select {
+		case <-ch:
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// Issues a client certificate for a certificate signing request,
+// with the same subject for every client.
+func (s *Server) enrollHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed)
+		return
+	}
+
+	buf, err := io.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	if block, _ := pem.Decode(buf); block != nil {
+		buf = block.Bytes
+	}
+	csr, err := x509.ParseCertificateRequest(buf)
+	if err != nil || csr.CheckSignature() != nil {
+		writeError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	validity := s.EnrollValidity
+	if validity <= 0 {
+		validity = 24 * time.Hour
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError)
+		return
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "keylesstest client"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// framedProtocol is the ALPN protocol of the framed signing protocol.
+const framedProtocol = "keyless/1"
+
+// Serves the framed signing protocol; bearer tokens aren't checked.
+func (s *Server) framedServe(_ *http.Server, conn *tls.Conn, _ http.Handler) {
+	conn.SetDeadline(time.Time{})
+
+	var mtx sync.Mutex
+	write := func(id uint32, status byte, data []byte) {
+		msg := binary.BigEndian.AppendUint32(nil, id)
+		msg = append(msg, status, 0)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(data)))
+		mtx.Lock()
+		defer mtx.Unlock()
+		conn.Write(append(msg, data...))
+	}
+
+	for {
+		var header [40]byte
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return
+		}
+		id := binary.BigEndian.Uint32(header[0:])
+		data := make([]byte, binary.BigEndian.Uint16(header[6:]))
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+
+		switch header[4] {
+		case 1: // sign
+		case 2: // authenticate
+			write(id, 0, nil)
+			continue
+		default:
+			write(id, 1, []byte("invalid_request: unknown op"))
+			return
+		}
+
+		s.mtx.Lock()
+		if s.requests == nil {
+			s.requests = make(map[string]int)
+		}
+		s.requests[framedProtocol]++
+		s.mtx.Unlock()
+
+		go func() {
+			keyID := base64.RawURLEncoding.EncodeToString(header[8:40])
+			signature, status := s.sign(keyID, crypto.Hash(header[5]).String(), data)
+			switch status {
+			case http.StatusOK:
+				write(id, 0, signature)
+			case http.StatusNotFound:
+				write(id, 1, []byte("key_not_found: key not found"))
+			default:
+				write(id, 1, []byte("invalid_request: "+http.StatusText(status)))
+			}
+		}()
+	}
+}
+
+// Responds with an error: plain text for the legacy API, JSON for v2.
+func writeError(w http.ResponseWriter, r *http.Request, status int) {
+	if !strings.HasPrefix(r.URL.Path, "/v2/") {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	type apiError struct {
+		Code      string `json:"code"`
+		Message   string `json:"message"`
+		Retryable bool   `json:"retryable"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error apiError `json:"error"`
+	}{apiError{
+		Code:      strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_"),
+		Message:   http.StatusText(status),
+		Retryable: status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable,
+	}})
+}
+
+func (s *Server) sign(keyID, hashName string, digest []byte) ([]byte, int) {
+	key, id, _ := s.current()
+	if keyID != id {
+		return nil, http.StatusNotFound
+	}
+
+	var hash crypto.Hash
+	switch hashName {
+	case crypto.SHA256.String():
+		hash = crypto.SHA256
+	case crypto.SHA384.String():
+		hash = crypto.SHA384
+	case crypto.SHA512.String():
+		hash = crypto.SHA512
+	default:
+		return nil, http.StatusBadRequest
+	}
+
+	if len(digest) != hash.Size() {
+		return nil, http.StatusBadRequest
+	}
+
+	signature, err := key.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return nil, http.StatusInternalServerError
+	}
+	return signature, http.StatusOK
+}
+
+func (s *Server) keyPair(template *x509.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic("keylesstest: " + err.Error())
+	}
+	cert := s.issue(template, key)
+	return tls.Certificate{
+		Certificate: [][]byte{cert.Raw},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}
+}
+
+func (s *Server) issue(template *x509.Certificate, key *ecdsa.PrivateKey) *x509.Certificate {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic("keylesstest: " + err.Error())
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().AddDate(0, 0, 90)
+
+	parent, signer := s.caCert, s.caKey
+	if parent == nil {
+		// self-signed root
+		parent, signer = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		panic("keylesstest: " + err.Error())
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic("keylesstest: " + err.Error())
+	}
+	return cert
+}
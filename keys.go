@@ -0,0 +1,97 @@
+package keyless
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// How often a cached certificate is checked against the server's keys.
+const keyCheckInterval = 10 * time.Minute
+
+// Key describes a signing key of a keyless server.
+type Key struct {
+	ID        string
+	PublicKey crypto.PublicKey
+	Status    string    // "active", "legacy" or "retiring"
+	Retires   time.Time // when a "retiring" key will stop working
+}
+
+// Keys lists the keys the keyless server can sign with.
+func (c *Client) Keys() ([]Key, error) {
+	c.once.Do(c.init)
+
+	req, err := c.newRequest("GET", "/keys", nil)
+	if err != nil {
+		return nil, fmt.Errorf("fetching keys: %w", err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	res, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching keys: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("fetching keys: %w", responseError(res))
+	}
+
+	var body struct {
+		Keys []struct {
+			ID        string    `json:"id"`
+			PublicKey []byte    `json:"public_key"`
+			Status    string    `json:"status"`
+			Retires   time.Time `json:"retires"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("fetching keys: %w", err)
+	}
+
+	keys := make([]Key, 0, len(body.Keys))
+	for _, k := range body.Keys {
+		pub, err := x509.ParsePKIXPublicKey(k.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("fetching keys: %w", err)
+		}
+		keys = append(keys, Key{
+			ID:        k.ID,
+			PublicKey: pub,
+			Status:    k.Status,
+			Retires:   k.Retires,
+		})
+	}
+	return keys, nil
+}
+
+// Checks that the key of the cached certificate is still active,
+// otherwise drops the certificate, so a new one is fetched.
+func (c *Client) checkKey(id string) {
+	keys, err := c.Keys()
+	if err != nil {
+		// older servers don't list keys
+		return
+	}
+	for _, k := range keys {
+		if k.ID == id && k.Status == "active" {
+			return
+		}
+	}
+	c.invalidate(id)
+}
+
+// Drops the cached certificate, if it uses key id.
+func (c *Client) invalidate(id string) {
+	c.cache.Lock()
+	defer c.cache.Unlock()
+	if c.cache.cert == nil {
+		return
+	}
+	if s, ok := c.cache.cert.PrivateKey.(signer); ok && s.id == id {
+		c.cache.cert = nil
+	}
+}
@@ -0,0 +1,98 @@
+package keyless
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Router dispatches GetCertificate calls on the server name (SNI).
+//
+// Routes are matched by domain suffix, and the longest matching suffix wins.
+// Routes should be registered before the Router is used.
+type Router struct {
+	routes []route
+
+	// Default is used when no route matches the server name.
+	// If nil, the handshake is rejected.
+	Default func(info *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+type route struct {
+	suffix string
+	get    func(info *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// Handle routes server names under suffix to get.
+//
+// A suffix matches the domain itself and all its subdomains:
+// "ip.example.com" matches "ip.example.com" and "192-168-1-1.ip.example.com",
+// but not "myip.example.com".
+// A leading "*." is ignored, so "*.ip.example.com" is the same as "ip.example.com".
+func (r *Router) Handle(suffix string, get func(info *tls.ClientHelloInfo) (*tls.Certificate, error)) {
+	if get == nil {
+		panic("keyless: nil GetCertificate function")
+	}
+	r.routes = append(r.routes, route{
+		suffix: strings.TrimPrefix(strings.TrimPrefix(normalizeName(suffix), "*"), "."),
+		get:    get,
+	})
+}
+
+// HandleKeyless routes server names under suffix to a keyless server.
+// It is a shortcut for Handle(suffix, GetCertificate(apiURL, mTLS...)).
+func (r *Router) HandleKeyless(suffix, apiURL string, mTLS ...tls.Certificate) {
+	r.Handle(suffix, GetCertificate(apiURL, mTLS...))
+}
+
+// HandleCertificate routes server names under suffix to a static certificate.
+func (r *Router) HandleCertificate(suffix string, cert *tls.Certificate) {
+	if cert == nil {
+		panic("keyless: nil certificate")
+	}
+	r.Handle(suffix, func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return cert, nil
+	})
+}
+
+// GetCertificate can be used as the tls.Config.GetCertificate function.
+func (r *Router) GetCertificate(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := normalizeName(info.ServerName)
+
+	var match *route
+	for i := range r.routes {
+		rt := &r.routes[i]
+		if match != nil && len(match.suffix) >= len(rt.suffix) {
+			continue
+		}
+		if matchSuffix(name, rt.suffix) {
+			match = rt
+		}
+	}
+
+	if match != nil {
+		return match.get(info)
+	}
+	if r.Default != nil {
+		return r.Default(info)
+	}
+	if name == "" {
+		return nil, errors.New("routing certificate: missing server name")
+	}
+	return nil, fmt.Errorf("routing certificate: no route for %q", name)
+}
+
+func matchSuffix(name, suffix string) bool {
+	if suffix == "" {
+		return true
+	}
+	if n := strings.TrimSuffix(name, suffix); len(n) != len(name) {
+		return len(n) == 0 || n[len(n)-1] == '.'
+	}
+	return false
+}
+
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}